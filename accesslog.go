@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access log formats, as nginx log_format definitions
+const (
+	COMMON_LOG_FORMAT   = `$remote_addr $remote_ident $remote_user [$time_local] "$request" $status $body_bytes_sent`
+	COMBINED_LOG_FORMAT = COMMON_LOG_FORMAT + ` "$http_referer" "$http_user_agent"`
+)
+
+var (
+	// fields the log_format variables are named as, if not by their name
+	accessFieldNames = map[string]string{
+		"time_local":      "time",
+		"time_iso8601":    "time",
+		"body_bytes_sent": "bytes",
+		"request_time":    "latency",
+		"http_referer":    "referer",
+		"http_user_agent": "user_agent",
+	}
+
+	// what the values of the variables look like, anything up to what
+	// follows the variable otherwise
+	accessVarPatterns = map[string]string{
+		"status":          `(\d{3})`,
+		"body_bytes_sent": `(\d+|-)`,
+		"bytes_sent":      `(\d+|-)`,
+		"request_time":    `([\d.]+|-)`,
+	}
+
+	// log_format variables, ie: $status or ${status}
+	accessVar = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+)
+
+// accessParser parses the lines of an access log written in the given
+// nginx log_format. The request is split into method, path and protocol,
+// and values of - are left out.
+type accessParser struct {
+	re *regexp.Regexp
+	// field names of the groups of the expression
+	keys []string
+}
+
+// newAccessParser compiles the given nginx log_format definition, ie:
+// $remote_addr - [$time_local] "$request" $status $request_time
+func newAccessParser(format string) (*accessParser, error) {
+	p := &accessParser{}
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	last := 0
+	for _, m := range accessVar.FindAllStringSubmatchIndex(format, -1) {
+		b.WriteString(regexp.QuoteMeta(format[last:m[0]]))
+		last = m[1]
+
+		var name string
+		if m[2] >= 0 {
+			name = format[m[2]:m[3]]
+		} else {
+			name = format[m[4]:m[5]]
+		}
+
+		pattern, ok := accessVarPatterns[name]
+		if !ok {
+			// the shortest value that lets the rest of the line match
+			pattern = `(.*?)`
+			if last == len(format) {
+				pattern = `(.*)`
+			}
+		}
+
+		b.WriteString(pattern)
+		p.keys = append(p.keys, name)
+	}
+
+	if len(p.keys) == 0 {
+		return nil, fmt.Errorf("no variables in log format %s", format)
+	}
+
+	b.WriteString(regexp.QuoteMeta(format[last:]))
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid log format %s: %s", format, err)
+	}
+
+	p.re = re
+	return p, nil
+}
+
+func (p *accessParser) parse(line string) (*Record, bool) {
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+
+	r := &Record{Format: "access", Fields: make([]Field, 0, len(p.keys)+2)}
+	for i, key := range p.keys {
+		v := m[i+1]
+		if v == "-" || v == "" {
+			continue
+		}
+
+		// GET /path HTTP/1.1
+		if key == "request" {
+			parts := strings.SplitN(v, " ", 3)
+			if len(parts) == 3 {
+				r.Fields = append(r.Fields,
+					Field{Key: "method", Value: parts[0]},
+					Field{Key: "path", Value: parts[1]},
+					Field{Key: "protocol", Value: parts[2]})
+				continue
+			}
+		}
+
+		if name, ok := accessFieldNames[key]; ok {
+			key = name
+		}
+
+		r.Fields = append(r.Fields, Field{Key: key, Value: v})
+	}
+
+	return r, true
+}
+
+// statusLevel returns the level of a request by its status code, error
+// for 5xx, warn for 4xx and info otherwise
+func statusLevel(status string) int {
+	switch {
+	case strings.HasPrefix(status, "5"):
+		return LEVEL_ERROR
+	case strings.HasPrefix(status, "4"):
+		return LEVEL_WARN
+	}
+
+	return LEVEL_INFO
+}
+
+// AccessSummary sums up the requests of an interval
+type AccessSummary struct {
+	Requests     int     `json:"requests"`
+	Rate         float64 `json:"rate"`
+	ClientErrors int     `json:"4xx"`
+	ServerErrors int     `json:"5xx"`
+	Bytes        int64   `json:"bytes"`
+	// average request time in seconds, 0 if not logged
+	Latency float64 `json:"latency,omitempty"`
+}
+
+func (s *AccessSummary) String() string {
+	out := fmt.Sprintf("-- %d requests (%.1f/s), 4xx: %d, 5xx: %d, %d bytes",
+		s.Requests, s.Rate, s.ClientErrors, s.ServerErrors, s.Bytes)
+	if s.Latency > 0 {
+		out += fmt.Sprintf(", latency: %s avg", time.Duration(s.Latency*float64(time.Second)).Round(time.Millisecond))
+	}
+
+	return out + " --"
+}
+
+// AccessStats counts the requests read from access logs, and sends a
+// summary of them to the printer every interval
+type AccessStats struct {
+	sync.Mutex
+	requests     int
+	clientErrors int
+	serverErrors int
+	bytes        int64
+	// sum of the request times, and the number of requests it was
+	// logged for
+	latency float64
+	timed   int
+}
+
+// add counts the request of the given record, if it's an access log
+// line
+func (s *AccessStats) add(r *Record) {
+	if r == nil || r.Format != "access" {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests++
+	status, _ := r.get("status")
+	switch statusLevel(status) {
+	case LEVEL_ERROR:
+		s.serverErrors++
+	case LEVEL_WARN:
+		s.clientErrors++
+	}
+
+	if v, ok := r.get("bytes"); ok {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		s.bytes += n
+	}
+
+	if v, ok := r.get("latency"); ok {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			s.latency += f
+			s.timed++
+		}
+	}
+}
+
+// summarize returns the summary of the counted requests over the given
+// interval, and starts counting again
+func (s *AccessStats) summarize(interval time.Duration) *AccessSummary {
+	s.Lock()
+	defer s.Unlock()
+
+	sum := &AccessSummary{
+		Requests:     s.requests,
+		Rate:         float64(s.requests) / interval.Seconds(),
+		ClientErrors: s.clientErrors,
+		ServerErrors: s.serverErrors,
+		Bytes:        s.bytes,
+	}
+
+	if s.timed > 0 {
+		sum.Latency = s.latency / float64(s.timed)
+	}
+
+	s.requests, s.clientErrors, s.serverErrors = 0, 0, 0
+	s.bytes, s.latency, s.timed = 0, 0, 0
+
+	return sum
+}
+
+// start sends a summary to the printer every interval
+func (s *AccessStats) start(interval time.Duration, content chan<- *PrintContent) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		debug("stats: sending access log summary")
+		content <- &PrintContent{
+			event:   EVENT_SUMMARY,
+			readAt:  now,
+			summary: s.summarize(interval),
+		}
+	}
+}
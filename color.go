@@ -1,33 +1,115 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
+
+// SGR parameters that can be combined into a Style
+var styleCodes = map[string]string{
+	"bold":       "1",
+	"dim":        "2",
+	"italic":     "3",
+	"underline":  "4",
+	"reverse":    "7",
+	"black":      "30",
+	"red":        "31",
+	"green":      "32",
+	"yellow":     "33",
+	"blue":       "34",
+	"magenta":    "35",
+	"cyan":       "36",
+	"white":      "37",
+	"bg-black":   "40",
+	"bg-red":     "41",
+	"bg-green":   "42",
+	"bg-yellow":  "43",
+	"bg-blue":    "44",
+	"bg-magenta": "45",
+	"bg-cyan":    "46",
+	"bg-white":   "47",
+}
+
+var (
+	boldRed     = mustStyle("bold", "red")
+	boldYellow  = mustStyle("bold", "yellow")
+	boldBlue    = mustStyle("bold", "blue")
+	boldMagenta = mustStyle("bold", "magenta")
+	boldGreen   = mustStyle("bold", "green")
+)
+
+// Style is a set of ANSI/VT100 SGR attributes, ie: bold red
+type Style struct {
+	codes string
+}
+
+// newStyle combines the given attribute names into a Style. An empty
+// Style leaves strings as they are.
+func newStyle(names ...string) (Style, error) {
+	codes := make([]string, 0, len(names))
+	for _, n := range names {
+		c, ok := styleCodes[strings.TrimSpace(n)]
+		if !ok {
+			return Style{}, fmt.Errorf("unknown style %s", n)
+		}
+
+		codes = append(codes, c)
+	}
+
+	return Style{codes: strings.Join(codes, ";")}, nil
+}
+
+// parseStyle parses a comma separated list of attribute names, ie:
+// bold,red
+func parseStyle(s string) (Style, error) {
+	return newStyle(strings.Split(s, ",")...)
+}
+
+// mustStyle is newStyle for the built in styles
+func mustStyle(names ...string) Style {
+	s, err := newStyle(names...)
+	if err != nil {
+		panic(err)
+	}
+
+	return s
+}
+
+// apply styles the given string, resetting all attributes at the end
+func (s Style) apply(str string) string {
+	if s.codes == "" {
+		return str
+	}
+
+	return fmt.Sprintf("\x1b[%sm%s\x1b[0m", s.codes, str)
+}
 
 // red colors the given string to red, with ANSI/VT100 88/256
 // color sequences
 func red(s string) string {
-	return fmt.Sprintf("\x1b[1;31m%s\x1b[0m", s)
+	return boldRed.apply(s)
 }
 
 // yellow colors the given string to yellow, with ANSI/VT100 88/256
 // color sequences
 func yellow(s string) string {
-	return fmt.Sprintf("\x1b[1;33m%s\x1b[0m", s)
+	return boldYellow.apply(s)
 }
 
 // blue colors the given string to blue, with ANSI/VT100 88/256
 // color sequences
 func blue(s string) string {
-	return fmt.Sprintf("\x1b[1;34m%s\x1b[0m", s)
+	return boldBlue.apply(s)
 }
 
 // magenta colors the given string to magenta, with ANSI/VT100 88/256
 // color sequences
 func magenta(s string) string {
-	return fmt.Sprintf("\x1b[1;35m%s\x1b[0m", s)
+	return boldMagenta.apply(s)
 }
 
 // green colors the given string to green, with ANSI/VT100 88/256
 // color sequences
 func green(s string) string {
-	return fmt.Sprintf("\x1b[1;32m%s\x1b[0m", s)
+	return boldGreen.apply(s)
 }
@@ -0,0 +1,95 @@
+package main
+
+// lineContext keeps track of the lines around filter matches of a
+// single file, so that lines before and after a match can be shown with
+// it. The lines before a match are kept in a ring buffer since it's not
+// known whether they are needed until a match comes along.
+type lineContext struct {
+	before int
+	after  int
+	// last lines that weren't shown, up to before
+	ring  []*Line
+	first int
+	// number of lines still to be shown after the last match
+	afterLeft int
+	// line counters, used to find gaps between shown lines
+	seq       int64
+	lastShown int64
+	shownAny  bool
+}
+
+func newLineContext(before, after int) *lineContext {
+	return &lineContext{
+		before: before,
+		after:  after,
+		ring:   make([]*Line, 0, before),
+	}
+}
+
+// process takes the next line of the file and whether it matched the
+// filter.
+// Returns the lines to be shown because of it, which can be none
+func (c *lineContext) process(l *Line, matched bool) []*Line {
+	c.seq++
+
+	if !matched {
+		l.context = true
+		if c.afterLeft > 0 {
+			c.afterLeft--
+			c.lastShown = c.seq
+
+			return []*Line{l}
+		}
+
+		c.push(l)
+		return nil
+	}
+
+	lines := make([]*Line, 0, len(c.ring)+2)
+
+	// is there a gap between the last shown line and this group
+	if c.shownAny && c.seq-int64(len(c.ring)) > c.lastShown+1 {
+		lines = append(lines, &Line{separator: true})
+	}
+
+	for i := 0; i < len(c.ring); i++ {
+		lines = append(lines, c.ring[(c.first+i)%len(c.ring)])
+	}
+
+	lines = append(lines, l)
+
+	c.ring = c.ring[:0]
+	c.first = 0
+	c.afterLeft = c.after
+	c.lastShown = c.seq
+	c.shownAny = true
+
+	return lines
+}
+
+// push adds a line to the ring buffer, dropping the oldest line if
+// it's full
+func (c *lineContext) push(l *Line) {
+	if c.before == 0 {
+		return
+	}
+
+	if len(c.ring) < c.before {
+		c.ring = append(c.ring, l)
+		return
+	}
+
+	c.ring[c.first] = l
+	c.first = (c.first + 1) % c.before
+}
+
+// reset drops the lines kept so far. Should be done when the file
+// content is started over, ex: when the file is truncated or replaced.
+// The next group of lines will be shown as non-contiguous.
+func (c *lineContext) reset() {
+	c.ring = c.ring[:0]
+	c.first = 0
+	c.afterLeft = 0
+	// leave a gap
+	c.seq++
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"syscall"
+	"time"
 )
 
 type Dispatch struct {
@@ -14,6 +15,11 @@ type Dispatch struct {
 //
 func (d *Dispatch) start(events <-chan syscall.InotifyEvent, done chan bool) {
 	debug("dispatch: starting")
+
+	// incomplete lines are shown once nothing more is written to them
+	ticker := time.NewTicker(PENDING_TIMEOUT)
+	defer ticker.Stop()
+
 	for {
 		// if no more tailers remain, signal a shutdown
 		if len(d.tailers) == 0 {
@@ -27,6 +33,12 @@ func (d *Dispatch) start(events <-chan syscall.InotifyEvent, done chan bool) {
 		case <-done:
 			debug("dispatch: received notice to shutdown")
 			return
+		case <-ticker.C:
+			for _, t := range d.tailers {
+				if c := t.flushPending(false); c != nil {
+					t.contentQ <- c
+				}
+			}
 		case event := <-events:
 			wd := uint32(event.Wd)
 			debug(fmt.Sprintf("dispatch: received inotify event for wd %d", wd))
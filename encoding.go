@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+var (
+	utf16le = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	utf16be = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+
+	// supported character encodings, nil means the content is already
+	// UTF-8 and is passed through as is
+	encodings = map[string]encoding.Encoding{
+		"utf-8":        nil,
+		"utf8":         nil,
+		"utf-16le":     utf16le,
+		"utf-16be":     utf16be,
+		"latin1":       charmap.ISO8859_1,
+		"latin-1":      charmap.ISO8859_1,
+		"iso-8859-1":   charmap.ISO8859_1,
+		"windows-1252": charmap.Windows1252,
+		"cp1252":       charmap.Windows1252,
+		"shift-jis":    japanese.ShiftJIS,
+		"shift_jis":    japanese.ShiftJIS,
+		"sjis":         japanese.ShiftJIS,
+		"euc-jp":       japanese.EUCJP,
+	}
+
+	// byte order marks, longest first
+	boms = []struct {
+		name string
+		mark []byte
+	}{
+		{"utf-8", []byte{0xef, 0xbb, 0xbf}},
+		{"utf-16le", []byte{0xff, 0xfe}},
+		{"utf-16be", []byte{0xfe, 0xff}},
+	}
+)
+
+// Encoding describes how the content of a tailed file is encoded
+type Encoding struct {
+	// the name given by the user, auto and utf-16 are resolved by
+	// looking at the BOM
+	requested string
+	name      string
+	enc       encoding.Encoding
+	// the encoded form of a new line
+	newline []byte
+	// width of a code unit, new lines are only searched at offsets
+	// aligned to this
+	unit int
+	// length of the BOM at the start of the file, if any
+	bom int64
+}
+
+// newEncoding creates an Encoding for the given name. auto (the
+// default) and utf-16 are decided later on by the BOM of the file,
+// falling back to UTF-8 and UTF-16LE respectively
+func newEncoding(name string) (*Encoding, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	e := &Encoding{requested: name}
+
+	switch name {
+	case "", "auto":
+		e.requested = "auto"
+		return e, e.use("utf-8")
+	case "utf-16":
+		return e, e.use("utf-16le")
+	}
+
+	return e, e.use(name)
+}
+
+// use switches to the named encoding
+func (e *Encoding) use(name string) error {
+	enc, ok := encodings[name]
+	if !ok {
+		return fmt.Errorf("unknown encoding %s", name)
+	}
+
+	e.name = name
+	e.enc = enc
+	e.unit = 1
+	e.newline = []byte("\n")
+
+	if enc != nil {
+		nl, err := enc.NewEncoder().Bytes([]byte("\n"))
+		if err != nil {
+			return err
+		}
+
+		e.newline = nl
+		if enc == utf16le || enc == utf16be {
+			e.unit = 2
+		}
+	}
+
+	return nil
+}
+
+// detect reads the start of the given file and looks for a BOM. If the
+// encoding is to be decided by the BOM, it's switched to the one the BOM
+// belongs to, or back to the default one if there's no BOM, ie: after
+// the file is replaced. The BOM length is recorded so that it can be
+// skipped while reading.
+func (e *Encoding) detect(f *os.File) {
+	e.bom = 0
+
+	switch e.requested {
+	case "auto":
+		_ = e.use("utf-8")
+	case "utf-16":
+		_ = e.use("utf-16le")
+	}
+
+	buf := make([]byte, 3)
+	n, _ := f.ReadAt(buf, 0)
+	buf = buf[:n]
+
+	for _, b := range boms {
+		if !bytes.HasPrefix(buf, b.mark) {
+			continue
+		}
+
+		switch {
+		case e.requested == "auto":
+			_ = e.use(b.name)
+		case e.requested == "utf-16" && b.name != "utf-8":
+			_ = e.use(b.name)
+		}
+
+		// only skip the BOM if it belongs to the encoding in use
+		if e.name == b.name || (b.name == "utf-8" && e.enc == nil) {
+			e.bom = int64(len(b.mark))
+			debug(fmt.Sprintf("encoding: found %s BOM in %s", b.name, f.Name()))
+		}
+
+		return
+	}
+}
+
+// isNewline checks if the given bytes start with the encoded new line.
+// off is the file offset of the given bytes and is used to make sure
+// that the match is on a code unit boundary
+func (e *Encoding) isNewline(b []byte, off int64) bool {
+	if (off-e.bom)%int64(e.unit) != 0 {
+		return false
+	}
+
+	return bytes.HasPrefix(b, e.newline)
+}
+
+// splitLines splits the given content into lines, without their new
+// lines. off is the file offset of the content, used to align the new
+// line search.
+// Returns the complete lines and the length of the content they cover,
+// anything after that is an incomplete line
+func (e *Encoding) splitLines(b []byte, off int64) ([][]byte, int) {
+	lines := make([][]byte, 0)
+	nl := len(e.newline)
+
+	start := 0
+	pos := 0
+	for {
+		i := bytes.Index(b[pos:], e.newline)
+		if i < 0 {
+			break
+		}
+
+		i += pos
+		if !e.isNewline(b[i:], off+int64(i)) {
+			// not on a code unit boundary, keep looking
+			pos = i + 1
+			continue
+		}
+
+		lines = append(lines, b[start:i])
+		start = i + nl
+		pos = start
+	}
+
+	return lines, start
+}
+
+// Decoder converts content read from a file to UTF-8. Bytes of an
+// incomplete character at the end of a read are held back until the
+// next read.
+type Decoder struct {
+	enc     *Encoding
+	tr      transform.Transformer
+	crlf    bool
+	pending []byte
+	cr      bool
+}
+
+func newDecoder(enc *Encoding, crlf bool) *Decoder {
+	d := &Decoder{
+		enc:  enc,
+		crlf: crlf,
+	}
+	d.reset()
+
+	return d
+}
+
+// reset drops any held back content. Should be done whenever the
+// read position jumps, ex: when the file is truncated or replaced.
+func (d *Decoder) reset() {
+	d.pending = nil
+	d.cr = false
+	d.tr = nil
+	if d.enc.enc != nil {
+		d.tr = d.enc.enc.NewDecoder()
+	}
+}
+
+// decode converts the given bytes to a UTF-8 string
+func (d *Decoder) decode(b []byte) string {
+	var s string
+	if d.tr == nil {
+		s = string(b)
+	} else {
+		s = d.transform(b)
+	}
+
+	if !d.crlf {
+		return s
+	}
+
+	if d.cr {
+		s = "\r" + s
+		d.cr = false
+	}
+
+	// a trailing CR could be followed by a LF in the next read
+	if strings.HasSuffix(s, "\r") {
+		s = s[:len(s)-1]
+		d.cr = true
+	}
+
+	return strings.Replace(s, "\r\n", "\n", -1)
+}
+
+// transform runs the bytes through the decoder of the encoding
+func (d *Decoder) transform(b []byte) string {
+	src := append(d.pending, b...)
+	d.pending = nil
+
+	dst := make([]byte, len(src)*2+8)
+	out := make([]byte, 0, len(dst))
+	for len(src) > 0 {
+		nDst, nSrc, err := d.tr.Transform(dst, src, false)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+
+		if err == transform.ErrShortDst {
+			continue
+		}
+
+		if err == transform.ErrShortSrc {
+			// incomplete character, wait for the rest of it
+			d.pending = append([]byte{}, src...)
+			break
+		}
+
+		if err != nil {
+			debug(fmt.Sprintf("decoder: error while decoding %s: %s", d.enc.name, err))
+			break
+		}
+	}
+
+	return string(out)
+}
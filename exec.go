@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// defaults of the limits of the commands run on matches
+const (
+	DEFAULT_EXEC_CONCURRENCY = 4
+	DEFAULT_EXEC_TIMEOUT     = 30 * time.Second
+)
+
+// Executor runs the commands of the exec rules, within the limits shared
+// by all of them
+type Executor struct {
+	// how long a command can run before it's killed
+	timeout time.Duration
+	// a rule doesn't run again for this long after it ran, 0 to run on
+	// every match
+	debounce time.Duration
+	// a slot is taken by each running command. Matches are skipped while
+	// all slots are taken.
+	slots chan struct{}
+	// where the output of the commands is logged, nil to drop it
+	log   io.Writer
+	logMu sync.Mutex
+}
+
+func newExecutor(concurrency int, timeout time.Duration, debounce time.Duration, log io.Writer) *Executor {
+	return &Executor{
+		timeout:  timeout,
+		debounce: debounce,
+		slots:    make(chan struct{}, concurrency),
+		log:      log,
+	}
+}
+
+// ExecRule runs a command when a line matches its expression
+type ExecRule struct {
+	sync.Mutex
+	re *regexp.Regexp
+	// the command, run with sh -c after it's rendered as a template.
+	// Every value the template prints is shell quoted, the lines can't
+	// be trusted.
+	command *template.Template
+	raw     string
+	// when the command last ran
+	last time.Time
+	exec *Executor
+}
+
+// execData is what the command template is executed with, for each
+// matching line
+type execData struct {
+	File   string
+	Base   string
+	Line   string
+	LineNo int64
+	Offset int64
+	Level  string
+	// the matching part of the line, and the groups of the expression
+	Match  string
+	Groups []string
+	// the named groups of the expression
+	Named  map[string]string
+	Fields map[string]string
+}
+
+// newExecRule parses a <regex>=><command> rule, ie:
+// 'OutOfMemoryError=>systemctl restart app'
+func (e *Executor) newExecRule(spec string) (*ExecRule, error) {
+	i := strings.Index(spec, "=>")
+	if i < 0 {
+		return nil, fmt.Errorf("missing => between the expression and the command in %s", spec)
+	}
+
+	re, err := regexp.Compile(spec[:i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %s: %s", spec[:i], err)
+	}
+
+	raw := strings.TrimSpace(spec[i+2:])
+	if raw == "" {
+		return nil, fmt.Errorf("missing command in %s", spec)
+	}
+
+	cmd, err := template.New("exec").
+		Funcs(templateFuncs).
+		Funcs(template.FuncMap{"quote": shellQuote}).
+		Option("missingkey=zero").
+		Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command %s: %s", raw, err)
+	}
+
+	for _, t := range cmd.Templates() {
+		quoteActions(t.Tree.Root)
+	}
+
+	return &ExecRule{re: re, command: cmd, raw: raw, exec: e}, nil
+}
+
+// check runs the command of the rule if the line matches, unless the
+// rule ran within the debounce interval or too many commands are running
+func (r *ExecRule) check(fname string, l *Line) {
+	m := r.re.FindStringSubmatch(l.text)
+	if m == nil {
+		return
+	}
+
+	r.Lock()
+	now := time.Now()
+	if r.exec.debounce > 0 && now.Sub(r.last) < r.exec.debounce {
+		r.Unlock()
+		debug(fmt.Sprintf("exec: skipping %s, ran %s ago", r.raw, now.Sub(r.last)))
+		return
+	}
+	r.last = now
+	r.Unlock()
+
+	data := &execData{
+		File:   fname,
+		Base:   filepath.Base(fname),
+		Line:   l.text,
+		LineNo: l.lineNo,
+		Offset: l.offset,
+		Level:  levelLabel(l.level),
+		Match:  m[0],
+		Groups: m[1:],
+		Named:  make(map[string]string),
+		Fields: fieldMap(l.record),
+	}
+
+	for i, name := range r.re.SubexpNames() {
+		if name != "" {
+			data.Named[name] = m[i]
+		}
+	}
+
+	var cmd bytes.Buffer
+	if err := r.command.Execute(&cmd, data); err != nil {
+		r.exec.logf("exec: error while rendering %s: %s\n", r.raw, err)
+		return
+	}
+
+	select {
+	case r.exec.slots <- struct{}{}:
+	default:
+		r.exec.logf("exec: too many commands running, skipping %s\n", cmd.String())
+		return
+	}
+
+	go func() {
+		defer func() { <-r.exec.slots }()
+		r.exec.run(cmd.String(), execEnv(data))
+	}()
+}
+
+// run runs the command with sh -c, killing it if it runs for too long
+func (e *Executor) run(command string, env []string) {
+	debug(fmt.Sprintf("exec: running %s", command))
+
+	var buf bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	// in a process group of its own, so that whatever it started is
+	// killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		e.logf("exec: %s failed: %s\n", command, err)
+		return
+	}
+
+	killed := make(chan struct{})
+	timer := time.AfterFunc(e.timeout, func() {
+		close(killed)
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	err := cmd.Wait()
+	timer.Stop()
+
+	select {
+	case <-killed:
+		err = fmt.Errorf("killed after %s", e.timeout)
+	default:
+	}
+
+	out := buf.Bytes()
+	if len(out) > 0 {
+		e.logf("exec: %s\n%s", command, out)
+		if !bytes.HasSuffix(out, []byte("\n")) {
+			e.logf("\n")
+		}
+	}
+
+	if err != nil {
+		e.logf("exec: %s failed: %s\n", command, err)
+	}
+}
+
+// logf writes to the log of the commands, if there's one
+func (e *Executor) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	debug(strings.TrimSpace(msg))
+
+	if e.log == nil {
+		return
+	}
+
+	e.logMu.Lock()
+	defer e.logMu.Unlock()
+	_, _ = io.WriteString(e.log, msg)
+}
+
+// execEnv returns the environment variables the match is given to the
+// command with
+func execEnv(d *execData) []string {
+	env := []string{
+		"TAILF_FILE=" + d.File,
+		"TAILF_LINE=" + d.Line,
+		"TAILF_LINE_NO=" + strconv.FormatInt(d.LineNo, 10),
+		"TAILF_OFFSET=" + strconv.FormatInt(d.Offset, 10),
+		"TAILF_LEVEL=" + d.Level,
+		"TAILF_MATCH=" + d.Match,
+	}
+
+	for i, g := range d.Groups {
+		env = append(env, fmt.Sprintf("TAILF_GROUP_%d=%s", i+1, g))
+	}
+
+	for name, v := range d.Named {
+		env = append(env, "TAILF_GROUP_"+strings.ToUpper(name)+"="+v)
+	}
+
+	return env
+}
+
+// quoteActions makes the actions of the template print their value
+// shell quoted, as if they ended with | quote. Those already ending with
+// quote are left as they are.
+func quoteActions(n parse.Node) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			quoteActions(c)
+		}
+	case *parse.ActionNode:
+		// declarations don't print anything
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+
+		cmds := n.Pipe.Cmds
+		if last := cmds[len(cmds)-1]; len(last.Args) > 0 {
+			if id, ok := last.Args[0].(*parse.IdentifierNode); ok && id.Ident == "quote" {
+				return
+			}
+		}
+
+		n.Pipe.Cmds = append(cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("quote").SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.RangeNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	case *parse.WithNode:
+		quoteActions(n.List)
+		quoteActions(n.ElseList)
+	}
+}
+
+// shellQuote quotes the value to be used as a single argument of a sh
+// command
+func shellQuote(v interface{}) string {
+	return "'" + strings.Replace(fmt.Sprint(v), "'", `'\''`, -1) + "'"
+}
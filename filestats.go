@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileStats prints how fast the files grow every interval, and a summary
+// of the whole run when tailing ends. It reads the counters the tailers
+// keep in their FileMetrics.
+type FileStats struct {
+	sync.Mutex
+	files []*FileMetrics
+	// the counters once the lines shown at the start were read, by file
+	firstLines map[*FileMetrics]int64
+	firstBytes map[*FileMetrics]int64
+	started    time.Time
+	// the counters at the previous interval, by file
+	lastLines map[*FileMetrics]int64
+	lastBytes map[*FileMetrics]int64
+	lastAt    time.Time
+}
+
+func newFileStats() *FileStats {
+	now := time.Now()
+	return &FileStats{
+		firstLines: make(map[*FileMetrics]int64),
+		firstBytes: make(map[*FileMetrics]int64),
+		started:    now,
+		lastLines:  make(map[*FileMetrics]int64),
+		lastBytes:  make(map[*FileMetrics]int64),
+		lastAt:     now,
+	}
+}
+
+func (s *FileStats) addFile(f *FileMetrics) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.files = append(s.files, f)
+}
+
+// mark takes the counters the rates are counted from, once the lines
+// shown at the start are read. Those don't count towards the rates.
+func (s *FileStats) mark() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, f := range s.files {
+		s.firstLines[f] = atomic.LoadInt64(&f.lines)
+		s.firstBytes[f] = atomic.LoadInt64(&f.bytes)
+		s.lastLines[f], s.lastBytes[f] = s.firstLines[f], s.firstBytes[f]
+	}
+
+	s.started = time.Now()
+	s.lastAt = s.started
+}
+
+// start prints the stats of the files every interval, until shutdown
+func (s *FileStats) start(interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			debug("stats: printing file stats")
+			s.print(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// print prints a line per file with the rates since the previous one
+func (s *FileStats) print(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	elapsed := now.Sub(s.lastAt).Seconds()
+	s.lastAt = now
+
+	width := s.nameWidth()
+	for _, f := range s.files {
+		lines, bytes := atomic.LoadInt64(&f.lines), atomic.LoadInt64(&f.bytes)
+		printErr(s.format(f, width, now, float64(lines-s.lastLines[f])/elapsed, float64(bytes-s.lastBytes[f])/elapsed))
+
+		s.lastLines[f], s.lastBytes[f] = lines, bytes
+	}
+}
+
+// summary prints the stats of the whole run, the rates being averages
+// since the lines shown at the start
+func (s *FileStats) summary() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.started)
+
+	printErr(fmt.Sprintf("-- tailed for %s --", elapsed.Round(time.Second)))
+
+	width := s.nameWidth()
+	for _, f := range s.files {
+		lines := atomic.LoadInt64(&f.lines) - s.firstLines[f]
+		bytes := atomic.LoadInt64(&f.bytes) - s.firstBytes[f]
+		printErr(s.format(f, width, now, float64(lines)/elapsed.Seconds(), float64(bytes)/elapsed.Seconds()))
+	}
+}
+
+// format formats the stats of a file, ie:
+// app.log  12.5 lines/s  1.2KB/s  1520 lines  last 2s ago  1 rotation
+// The lines shown at the start aren't part of the total, like the rates.
+func (s *FileStats) format(f *FileMetrics, width int, now time.Time, lineRate, byteRate float64) string {
+	last := "no lines"
+	if at := atomic.LoadInt64(&f.lastLine); at > 0 {
+		last = fmt.Sprintf("last %s ago", now.Sub(time.Unix(0, at)).Round(time.Second))
+	}
+
+	rotations := atomic.LoadInt64(&f.rotations)
+	plural := "s"
+	if rotations == 1 {
+		plural = ""
+	}
+
+	name := filepath.Base(f.name)
+	return fmt.Sprintf("%s%s  %.1f lines/s  %s/s  %d lines  %s  %d rotation%s",
+		name, strings.Repeat(" ", width-len(name)), lineRate, formatBytes(byteRate),
+		atomic.LoadInt64(&f.lines)-s.firstLines[f], last, rotations, plural)
+}
+
+// nameWidth returns the length of the longest file name, to align the
+// lines
+func (s *FileStats) nameWidth() int {
+	width := 0
+	for _, f := range s.files {
+		if n := len(filepath.Base(f.name)); n > width {
+			width = n
+		}
+	}
+
+	return width
+}
+
+// formatBytes shows a number of bytes with a unit, ie: 1.5MB
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
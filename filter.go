@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// LineFilter decides which lines of a file are shown. A line is shown if
+// it matches any of the match expressions (or if there are none), none
+// of the exclude expressions, and all of the queries.
+type LineFilter struct {
+	match   []*regexp.Regexp
+	exclude []*regexp.Regexp
+	// queries on the fields of structured lines
+	where []*Query
+	// apps of the syslog lines shown, any if empty
+	apps []string
+	// lines below this level are hidden, 0 to show all. Lines of
+	// unknown level are always shown.
+	minLevel int
+}
+
+// newLineFilter compiles the given expressions into a LineFilter. The
+// insensitive lists are matched ignoring case.
+// Returns nil if there's nothing to filter by
+func newLineFilter(match, imatch, exclude, iexclude []string) (*LineFilter, error) {
+	if len(match)+len(imatch)+len(exclude)+len(iexclude) == 0 {
+		return nil, nil
+	}
+
+	f := &LineFilter{}
+
+	var err error
+	if f.match, err = compileAll(f.match, match, ""); err != nil {
+		return nil, err
+	}
+
+	if f.match, err = compileAll(f.match, imatch, "(?i)"); err != nil {
+		return nil, err
+	}
+
+	if f.exclude, err = compileAll(f.exclude, exclude, ""); err != nil {
+		return nil, err
+	}
+
+	if f.exclude, err = compileAll(f.exclude, iexclude, "(?i)"); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// compileAll compiles the given expressions with the given flag prefix
+// and appends them to the list
+func compileAll(res []*regexp.Regexp, exprs []string, flags string) ([]*regexp.Regexp, error) {
+	for _, e := range exprs {
+		re, err := regexp.Compile(flags + e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %s: %s", e, err)
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// addQueries parses the given query expressions and adds them to the
+// filter, creating the filter if it's nil
+func (f *LineFilter) addQueries(exprs []string, levelKeys []string) (*LineFilter, error) {
+	if len(exprs) == 0 {
+		return f, nil
+	}
+
+	if f == nil {
+		f = &LineFilter{}
+	}
+
+	for _, e := range exprs {
+		q, err := newQuery(e, levelKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		f.where = append(f.where, q)
+	}
+
+	return f, nil
+}
+
+// addApps only shows the syslog lines of the given apps, creating the
+// filter if it's nil
+func (f *LineFilter) addApps(apps []string) *LineFilter {
+	if len(apps) == 0 {
+		return f
+	}
+
+	if f == nil {
+		f = &LineFilter{}
+	}
+
+	f.apps = append(f.apps, apps...)
+	return f
+}
+
+// setMinLevel hides the lines below the given level, creating the
+// filter if it's nil
+func (f *LineFilter) setMinLevel(level int) *LineFilter {
+	if level == 0 {
+		return f
+	}
+
+	if f == nil {
+		f = &LineFilter{}
+	}
+
+	f.minLevel = level
+	return f
+}
+
+// matches checks if the given line should be shown
+func (f *LineFilter) matches(l *Line) bool {
+	if l.level > 0 && l.level < f.minLevel {
+		return false
+	}
+
+	if len(f.apps) > 0 && !f.matchesApp(l.record) {
+		return false
+	}
+
+	for _, q := range f.where {
+		if !q.matches(l.record) {
+			return false
+		}
+	}
+
+	for _, re := range f.exclude {
+		if re.MatchString(l.text) {
+			return false
+		}
+	}
+
+	if len(f.match) == 0 {
+		return true
+	}
+
+	for _, re := range f.match {
+		if re.MatchString(l.text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesApp checks if the record is of one of the apps of the filter
+func (f *LineFilter) matchesApp(r *Record) bool {
+	if r == nil {
+		return false
+	}
+
+	app, ok := r.get("app")
+	if !ok {
+		return false
+	}
+
+	for _, a := range f.apps {
+		if a == app {
+			return true
+		}
+	}
+
+	return false
+}
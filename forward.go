@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// defaults of forwarding to a syslog server
+const (
+	DEFAULT_FORWARD_BUFFER = 10000
+	// how long to wait for the buffered lines to be sent on shutdown
+	FORWARD_FLUSH_TIMEOUT = 2 * time.Second
+	// the longest wait between connection attempts
+	FORWARD_MAX_BACKOFF = 30 * time.Second
+	// longest app name and host name of a message (RFC 5424)
+	FORWARD_MAX_APP  = 48
+	FORWARD_MAX_HOST = 255
+	// facility of the forwarded lines, user-level messages
+	FORWARD_FACILITY = 1
+	// longest message sent over udp, longer ones are cut (RFC 5426)
+	FORWARD_UDP_MAX = 2048
+)
+
+// Forwarder sends the printed lines to a syslog server, as RFC 5424
+// messages. Lines are buffered while the server can't be reached.
+type Forwarder struct {
+	// udp, tcp or tls, and the address of the server
+	network string
+	addr    string
+	tls     *tls.Config
+	host    string
+	// app name of the lines of each file
+	apps   map[string]string
+	buffer ForwardBuffer
+	// pinged when lines are buffered
+	wake chan struct{}
+	// closed once all the lines are buffered, and once the buffer is
+	// flushed after that
+	stop     chan struct{}
+	finished chan struct{}
+	// only used by start, which closes it when it's done
+	conn net.Conn
+}
+
+// newForwarder creates a Forwarder for the given url, one of
+// syslog://host:514 (udp), syslog+tcp://host:514 or
+// syslog+tls://host:6514. The server certificate is checked against the
+// system roots, or the ones in the ca file if given.
+func newForwarder(rawurl string, ca string, buffer ForwardBuffer) (*Forwarder, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forwarder{
+		apps:     make(map[string]string),
+		buffer:   buffer,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+
+	port := "514"
+	switch u.Scheme {
+	case "syslog", "syslog+udp":
+		f.network = "udp"
+	case "syslog+tcp":
+		f.network = "tcp"
+	case "syslog+tls":
+		f.network = "tcp"
+		port = "6514"
+		f.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unknown scheme %s, expected syslog, syslog+tcp or syslog+tls", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing the host of %s", rawurl)
+	}
+
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	f.addr = net.JoinHostPort(u.Hostname(), port)
+
+	if ca != "" {
+		if f.tls == nil {
+			return nil, errors.New("a ca file is only used with syslog+tls")
+		}
+
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		f.tls.RootCAs = x509.NewCertPool()
+		if !f.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", ca)
+		}
+	}
+
+	host, _ := os.Hostname()
+	f.host = syslogName(host, FORWARD_MAX_HOST)
+
+	return f, nil
+}
+
+// setApp sets the app name the lines of the file are sent with. It's
+// made to fit in a message if it doesn't.
+func (f *Forwarder) setApp(fname, app string) {
+	f.apps[fname] = syslogName(app, FORWARD_MAX_APP)
+}
+
+// validSyslogName checks if the name can be used as is in a message:
+// printable ascii, without spaces, up to the given length
+func validSyslogName(name string, max int) bool {
+	return name != "" && syslogName(name, max) == name
+}
+
+// syslogName makes the name fit in a message, replacing what isn't
+// printable ascii, ie: spaces, with _ and cutting it to the given
+// length. An empty name is -, the nil value.
+func syslogName(name string, max int) string {
+	if name == "" {
+		return "-"
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+
+	if len(b) > max {
+		b = b[:max]
+	}
+
+	return string(b)
+}
+
+// write buffers the lines of the content to be sent. Separators and
+// events aren't sent.
+func (f *Forwarder) write(c *PrintContent) error {
+	if c.event != "" {
+		return nil
+	}
+
+	queued := false
+	for _, l := range c.lines {
+		if l.separator {
+			continue
+		}
+
+		f.buffer.push(f.message(c, l))
+		queued = true
+	}
+
+	if queued {
+		select {
+		case f.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// flush does nothing, the lines are sent as soon as they're buffered
+func (f *Forwarder) flush() error {
+	return nil
+}
+
+// message formats the line as an RFC 5424 message, ie:
+// <11>1 2019-06-01T10:00:00.123Z web-1 app - - - connection refused
+func (f *Forwarder) message(c *PrintContent, l *Line) []byte {
+	app := f.apps[c.filename]
+	if app == "" {
+		app = syslogName(filepath.Base(c.filename), FORWARD_MAX_APP)
+	}
+
+	pri := FORWARD_FACILITY*8 + syslogSeverity(l.level)
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s - - - %s",
+		pri, c.readAt.Format("2006-01-02T15:04:05.000000Z07:00"), f.host, app, l.text))
+}
+
+// syslogSeverity returns the syslog severity of the level, info if it's
+// unknown
+func syslogSeverity(level int) int {
+	if level == LEVEL_TRACE {
+		level = LEVEL_DEBUG
+	}
+
+	for severity, l := range syslogSeverities {
+		if l == level {
+			return severity
+		}
+	}
+
+	return 6
+}
+
+// start sends the buffered lines as they come, reconnecting with a
+// backoff when the server can't be reached. It runs until the
+// forwarder is closed.
+func (f *Forwarder) start() {
+	defer close(f.finished)
+	defer func() {
+		if f.conn != nil {
+			_ = f.conn.Close()
+		}
+	}()
+
+	wait := time.Second
+	for {
+		if err := f.send(); err != nil {
+			debug(fmt.Sprintf("forward: %s, retrying in %s", err, wait))
+
+			select {
+			case <-time.After(wait):
+			case <-f.stop:
+				return
+			}
+
+			if wait *= 2; wait > FORWARD_MAX_BACKOFF {
+				wait = FORWARD_MAX_BACKOFF
+			}
+			continue
+		}
+		wait = time.Second
+
+		select {
+		case <-f.wake:
+		case <-f.stop:
+			// whatever came in last
+			if err := f.send(); err != nil {
+				debug(fmt.Sprintf("forward: couldn't send the buffered lines: %s", err))
+			}
+			return
+		}
+	}
+}
+
+// close stops the sender once the lines written last are buffered, and
+// waits for them to be sent, for a while. The buffer is left to the
+// sender if it's still at it.
+func (f *Forwarder) close() error {
+	close(f.stop)
+
+	finished := true
+	select {
+	case <-f.finished:
+	case <-time.After(FORWARD_FLUSH_TIMEOUT):
+		debug("forward: gave up on sending the buffered lines")
+		finished = false
+	}
+
+	if n := f.buffer.len(); n > 0 {
+		printErr(fmt.Sprintf("forward: %d lines couldn't be sent to %s", n, f.addr))
+	}
+
+	if !finished {
+		return nil
+	}
+
+	return f.buffer.close()
+}
+
+// send sends the buffered lines, connecting first if needed. A line is
+// dropped from the buffer once it's written.
+func (f *Forwarder) send() error {
+	for {
+		msg, ok := f.buffer.peek()
+		if !ok {
+			return nil
+		}
+
+		if f.conn == nil {
+			conn, err := f.dial()
+			if err != nil {
+				return err
+			}
+
+			debug(fmt.Sprintf("forward: connected to %s", f.addr))
+			f.conn = conn
+		}
+
+		if err := f.writeMessage(msg); err != nil {
+			// the message itself can't be sent, retrying won't help
+			if permanentError(err) {
+				printErr(fmt.Sprintf("forward: dropping a line: %s", err))
+				f.buffer.pop()
+				continue
+			}
+
+			_ = f.conn.Close()
+			f.conn = nil
+			return err
+		}
+
+		f.buffer.pop()
+	}
+}
+
+func (f *Forwarder) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if f.tls != nil {
+		return tls.DialWithDialer(dialer, f.network, f.addr, f.tls)
+	}
+
+	return dialer.Dial(f.network, f.addr)
+}
+
+// writeMessage sends a single message. Over tcp, messages are framed with octet
+// counting (RFC 6587), a datagram carries one over udp, cut down to
+// FORWARD_UDP_MAX.
+func (f *Forwarder) writeMessage(msg []byte) error {
+	_ = f.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	if f.network == "udp" {
+		_, err := f.conn.Write(truncateMessage(msg, FORWARD_UDP_MAX))
+		return err
+	}
+
+	_, err := f.conn.Write(append([]byte(strconv.Itoa(len(msg))+" "), msg...))
+	return err
+}
+
+// truncateMessage cuts the message down to the size, without splitting
+// a character
+func truncateMessage(msg []byte, size int) []byte {
+	if len(msg) <= size {
+		return msg
+	}
+
+	for size > 0 && !utf8.RuneStart(msg[size]) {
+		size--
+	}
+
+	return msg[:size]
+}
+
+// permanentError checks if the error is about the message rather than
+// the connection, ie: a datagram too large to be sent
+func permanentError(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+
+	if sc, ok := err.(*os.SyscallError); ok {
+		err = sc.Err
+	}
+
+	return err == syscall.EMSGSIZE
+}
+
+// ForwardBuffer holds the messages waiting to be sent, in order
+type ForwardBuffer interface {
+	push(msg []byte)
+	// the first message, if there's one
+	peek() ([]byte, bool)
+	// drops the first message
+	pop()
+	len() int
+	close() error
+}
+
+// memoryBuffer holds up to a number of messages, dropping the oldest
+// ones when it's full
+type memoryBuffer struct {
+	sync.Mutex
+	messages [][]byte
+	size     int
+	dropped  int
+}
+
+func newMemoryBuffer(size int) *memoryBuffer {
+	return &memoryBuffer{messages: make([][]byte, 0), size: size}
+}
+
+func (b *memoryBuffer) push(msg []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.messages) >= b.size {
+		b.messages = b.messages[1:]
+		if b.dropped++; b.dropped == 1 {
+			printErr(fmt.Sprintf("forward: buffer of %d lines is full, dropping the oldest ones", b.size))
+		}
+	}
+
+	b.messages = append(b.messages, msg)
+}
+
+func (b *memoryBuffer) peek() ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.messages) == 0 {
+		return nil, false
+	}
+
+	return b.messages[0], true
+}
+
+func (b *memoryBuffer) pop() {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.messages) > 0 {
+		b.messages = b.messages[1:]
+	}
+}
+
+func (b *memoryBuffer) len() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return len(b.messages)
+}
+
+func (b *memoryBuffer) close() error {
+	return nil
+}
+
+// diskBuffer keeps the messages in a file, octet counted, so they
+// outlive a restart. The file is emptied once all of them are sent.
+type diskBuffer struct {
+	sync.Mutex
+	file *os.File
+	// reads the messages, from the offset of the first one
+	reader *bufio.Reader
+	offset int64
+	// the first message, once read
+	next  []byte
+	count int
+}
+
+// newDiskBuffer opens the buffer file, with the messages left in it by
+// a previous run
+func newDiskBuffer(path string) (*diskBuffer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &diskBuffer{file: file}
+	b.rewind(0)
+
+	// count the messages left over
+	for {
+		msg, err := b.read()
+		if err != nil {
+			break
+		}
+
+		b.offset += int64(len(strconv.Itoa(len(msg))) + 1 + len(msg))
+		b.count++
+	}
+
+	// a message cut short by a crash is dropped, the next ones are
+	// written after the complete ones
+	if err := file.Truncate(b.offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	b.rewind(0)
+	if b.count > 0 {
+		debug(fmt.Sprintf("forward: %d lines left in %s", b.count, path))
+	}
+
+	return b, nil
+}
+
+// rewind reads the messages from the given offset
+func (b *diskBuffer) rewind(offset int64) {
+	b.offset = offset
+	b.next = nil
+	b.reader = bufio.NewReader(io.NewSectionReader(b.file, offset, 1<<62))
+}
+
+// read reads a message from the file
+func (b *diskBuffer) read() ([]byte, error) {
+	n, err := b.reader.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.Atoi(strings.TrimSuffix(n, " "))
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("corrupt buffer at %d", b.offset)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(b.reader, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (b *diskBuffer) push(msg []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	frame := append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	if _, err := b.file.WriteAt(frame, b.end()); err != nil {
+		printErr(fmt.Sprintf("forward: couldn't buffer a line: %s", err))
+		return
+	}
+
+	b.count++
+}
+
+// end returns the size of the file
+func (b *diskBuffer) end() int64 {
+	info, err := b.file.Stat()
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+func (b *diskBuffer) peek() ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.count == 0 {
+		return nil, false
+	}
+
+	if b.next == nil {
+		// read afresh, the reader might have seen the end of the file
+		// before the message was written
+		b.rewind(b.offset)
+		msg, err := b.read()
+		if err != nil {
+			printErr(fmt.Sprintf("forward: couldn't read the buffer: %s", err))
+			b.truncate()
+			return nil, false
+		}
+
+		b.next = msg
+	}
+
+	return b.next, true
+}
+
+func (b *diskBuffer) pop() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.next == nil {
+		return
+	}
+
+	b.offset += int64(len(strconv.Itoa(len(b.next))) + 1 + len(b.next))
+	b.next = nil
+	b.count--
+
+	if b.count == 0 {
+		b.truncate()
+	}
+}
+
+// truncate empties the file
+func (b *diskBuffer) truncate() {
+	if err := b.file.Truncate(0); err != nil {
+		debug(fmt.Sprintf("forward: couldn't empty the buffer: %s", err))
+	}
+
+	b.count = 0
+	b.rewind(0)
+}
+
+func (b *diskBuffer) len() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.count
+}
+
+func (b *diskBuffer) close() error {
+	return b.file.Close()
+}
@@ -1,3 +1,5 @@
-module main
+module tailf
 
-go 1.12
+go 1.18
+
+require golang.org/x/text v0.13.0
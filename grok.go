@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// grokPatterns is the library of named patterns grok expressions are
+// made of. They follow the ones of Logstash, rewritten for Go regexps.
+// Pattern files add to it.
+var grokPatterns = map[string]string{
+	"USERNAME":          `[a-zA-Z0-9._-]+`,
+	"USER":              `%{USERNAME}`,
+	"EMAILLOCALPART":    `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":      `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":               `[+-]?[0-9]+`,
+	"BASE10NUM":         `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":            `%{BASE10NUM}`,
+	"BASE16NUM":         `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":            `[1-9][0-9]*`,
+	"NONNEGINT":         `[0-9]+`,
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":               `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+	"IPV4":              `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":              `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|%{IPV4})?(?:%\w+)?`,
+	"IP":                `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":          `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":          `%{IPORHOST}:%{POSINT}`,
+	"UNIXPATH":          `(?:/[\w_%!$@:.,+~-]*)+`,
+	"WINPATH":           `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":              `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":          `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIHOST":           `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":           `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":          `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM":      `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":               `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?%{URIHOST}?(?:%{URIPATHPARAM})?`,
+	"MONTH":             `\b(?:[Jj]an(?:uary|uar)?|[Ff]eb(?:ruary|ruar)?|[Mm](?:a|ä)?r(?:ch|z)?|[Aa]pr(?:il)?|[Mm]a(?:y|i)?|[Jj]un(?:e|i)?|[Jj]ul(?:y|i)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo](?:c|k)?t(?:ober)?|[Nn]ov(?:ember)?|[Dd]e(?:c|z)(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHNUM2":         `0[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `\d\d(?:\d\d)?`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"ISO8601_SECOND":    `%{SECOND}|60`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?(?:%{ISO8601_TIMEZONE})?`,
+	"DATE":              `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"TZ":                `[A-Z]{3}`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"PROG":              `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG":        `%{PROG:app}(?:\[%{POSINT:pid}\])?`,
+	"SYSLOGHOST":        `%{IPORHOST}`,
+	"SYSLOGBASE":        `%{SYSLOGTIMESTAMP:time} %{SYSLOGHOST:host} %{SYSLOGPROG}:`,
+	"LOGLEVEL":          `(?i:alert|trace|debug|notice|info(?:rmation)?|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|severe|emerg(?:ency)?)`,
+	"COMMONAPACHELOG":   `%{IPORHOST:remote_addr} %{USER:ident} %{USER:remote_user} \[%{HTTPDATE:time}\] "(?:%{WORD:method} %{NOTSPACE:path}(?: HTTP/%{NUMBER:protocol})?|%{DATA:request})" %{NUMBER:status:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QUOTEDSTRING:referer} %{QUOTEDSTRING:user_agent}`,
+}
+
+// grok references to patterns, ie: %{NUMBER}, %{NUMBER:took} or
+// %{NUMBER:took:float}
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::([\w.@\-\[\]]+))?(?::(int|float|string))?\}`)
+
+// loadGrokPatterns adds the patterns of the given file to the library.
+// Each line holds a name and the pattern, separated by a space, ie:
+// MYAPP_ID [A-Z]{3}-%{INT}. Empty lines and # comments are skipped
+func loadGrokPatterns(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return fmt.Errorf("%s:%d: missing the pattern of %s", path, n, line)
+		}
+
+		grokPatterns[line[:i]] = strings.TrimSpace(line[i:])
+	}
+
+	return scanner.Err()
+}
+
+// grokParser parses lines with a grok expression. The fields are the
+// named references of the expression.
+type grokParser struct {
+	re *regexp.Regexp
+	// field and type of each group of the expression, by group name
+	fields map[string]grokField
+}
+
+type grokField struct {
+	key string
+	// int, float or string
+	typ string
+}
+
+// newGrokParser compiles the grok expression, ie:
+// %{TIMESTAMP_ISO8601:time} %{LOGLEVEL:level} %{GREEDYDATA:msg}
+func newGrokParser(expr string) (*grokParser, error) {
+	p := &grokParser{fields: make(map[string]grokField)}
+
+	s, err := p.expand(expr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.fields) == 0 {
+		return nil, fmt.Errorf("no fields in grok expression %s", expr)
+	}
+
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid grok expression %s: %s", expr, err)
+	}
+
+	p.re = re
+	return p, nil
+}
+
+// expand replaces the pattern references of the expression with the
+// patterns, the named ones wrapped in a group. seen holds the patterns
+// being expanded, to catch the ones that refer to themselves.
+func (p *grokParser) expand(expr string, seen []string) (string, error) {
+	var b strings.Builder
+
+	last := 0
+	for _, m := range grokRef.FindAllStringSubmatchIndex(expr, -1) {
+		b.WriteString(expr[last:m[0]])
+		last = m[1]
+
+		name := expr[m[2]:m[3]]
+		pattern, ok := grokPatterns[name]
+		if !ok {
+			return "", fmt.Errorf("unknown grok pattern %s", name)
+		}
+
+		for _, s := range seen {
+			if s == name {
+				return "", fmt.Errorf("grok pattern %s refers to itself", name)
+			}
+		}
+
+		inner, err := p.expand(pattern, append(seen, name))
+		if err != nil {
+			return "", err
+		}
+
+		if m[4] < 0 {
+			b.WriteString("(?:" + inner + ")")
+			continue
+		}
+
+		f := grokField{key: expr[m[4]:m[5]], typ: "string"}
+		if m[6] >= 0 {
+			f.typ = expr[m[6]:m[7]]
+		}
+
+		// field names aren't always valid group names
+		group := fmt.Sprintf("f%d", len(p.fields))
+		p.fields[group] = f
+		b.WriteString("(?P<" + group + ">" + inner + ")")
+	}
+
+	b.WriteString(expr[last:])
+	return b.String(), nil
+}
+
+func (p *grokParser) parse(line string) (*Record, bool) {
+	m := p.re.FindStringSubmatchIndex(line)
+	if m == nil {
+		return nil, false
+	}
+
+	r := &Record{Format: "grok", Fields: make([]Field, 0, len(p.fields))}
+	for i, name := range p.re.SubexpNames() {
+		f, ok := p.fields[name]
+		if !ok || m[2*i] < 0 {
+			continue
+		}
+
+		v := line[m[2*i]:m[2*i+1]]
+		r.Fields = append(r.Fields, Field{Key: f.key, Value: v, Literal: f.isNumber(v)})
+	}
+
+	return r, true
+}
+
+// isNumber checks if the value of an int or float field can be read as
+// such, to be given as a number in json
+func (f grokField) isNumber(v string) bool {
+	var err error
+	switch f.typ {
+	case "int":
+		_, err = strconv.ParseInt(v, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(v, 64)
+	default:
+		return false
+	}
+
+	return err == nil && json.Valid([]byte(v))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// built in highlight rules, selected with --highlight-preset
+var highlightPresets = map[string][]string{
+	"levels": {
+		"bold,red:\\b(FATAL|PANIC|CRIT(ICAL)?|ERR(OR)?)\\b",
+		"bold,yellow:\\bWARN(ING)?\\b",
+		"green:\\bINFO\\b",
+		"blue:\\b(DEBUG|TRACE)\\b",
+	},
+}
+
+// HighlightRule styles the parts of a line matching an expression
+type HighlightRule struct {
+	re    *regexp.Regexp
+	style Style
+}
+
+// newHighlightRule parses a rule given as [style:]regex, ie:
+// bold,yellow:WARN. Without a style, matches are shown in bold red.
+func newHighlightRule(s string) (*HighlightRule, error) {
+	style := boldRed
+	expr := s
+
+	if i := strings.Index(s, ":"); i > 0 {
+		if st, err := parseStyle(s[:i]); err == nil {
+			style = st
+			expr = s[i+1:]
+		}
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %s: %s", expr, err)
+	}
+
+	return &HighlightRule{re: re, style: style}, nil
+}
+
+// newHighlightRules creates the rules for the given highlight flags and
+// presets, in the given order
+func newHighlightRules(rules []string, presets []string) ([]*HighlightRule, error) {
+	// a copy, the presets aren't appended to the flags of the options
+	all := make([]string, 0, len(rules))
+	all = append(all, rules...)
+	for _, p := range presets {
+		preset, ok := highlightPresets[p]
+		if !ok {
+			return nil, fmt.Errorf("unknown highlight preset %s", p)
+		}
+
+		all = append(all, preset...)
+	}
+
+	res := make([]*HighlightRule, 0, len(all))
+	for _, r := range all {
+		h, err := newHighlightRule(r)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, h)
+	}
+
+	return res, nil
+}
+
+// highlight styles the parts of the line matched by the rules. When
+// rules overlap, the first one wins. The rest of the line is styled
+// with the base style, which is restored after each highlighted part.
+func highlight(line string, base Style, rules []*HighlightRule) string {
+	if len(rules) == 0 {
+		return base.apply(line)
+	}
+
+	// style of each byte of the line, nil if not highlighted
+	marks := make([]*Style, len(line))
+	found := false
+	for _, r := range rules {
+		for _, loc := range r.re.FindAllStringIndex(line, -1) {
+			for i := loc[0]; i < loc[1]; i++ {
+				if marks[i] == nil {
+					marks[i] = &r.style
+					found = true
+				}
+			}
+		}
+	}
+
+	if !found {
+		return base.apply(line)
+	}
+
+	var b strings.Builder
+	start := 0
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && marks[i] == marks[start] {
+			continue
+		}
+
+		if marks[start] == nil {
+			b.WriteString(base.apply(line[start:i]))
+		} else {
+			b.WriteString(marks[start].apply(line[start:i]))
+		}
+		start = i
+	}
+
+	return b.String()
+}
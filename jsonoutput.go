@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonRecord is a single object of the json output, either a line read
+// from a file or an event that happened to it
+type jsonRecord struct {
+	Type   string `json:"type"`
+	File   string `json:"file"`
+	Inode  uint64 `json:"inode"`
+	Time   string `json:"time"`
+	Offset *int64 `json:"offset,omitempty"`
+	LineNo int64  `json:"line_no,omitempty"`
+	// the line, any invalid UTF-8 replaced
+	Line *string `json:"line,omitempty"`
+	// the raw bytes of the line, only given if it isn't valid UTF-8
+	Raw   string `json:"raw_base64,omitempty"`
+	Level string `json:"level,omitempty"`
+	// the fields of structured lines, in their order
+	Fields  json.RawMessage `json:"fields,omitempty"`
+	Context bool            `json:"context,omitempty"`
+	// the requests of the interval, for summaries
+	Summary *AccessSummary `json:"summary,omitempty"`
+}
+
+// printJSON prints the given PrintContent as one json object per line
+// or event. Colors and prefixes are not used.
+func (p *ContentPrinter) printJSON(c *PrintContent) {
+	for _, r := range jsonRecords(c) {
+		p.writeJSON(r)
+	}
+}
+
+// jsonRecords returns the json objects of the lines of the content, or
+// of its event
+func jsonRecords(c *PrintContent) []*jsonRecord {
+	ts := c.readAt.Format(time.RFC3339Nano)
+
+	if c.event != "" {
+		return []*jsonRecord{{
+			Type:    c.event,
+			File:    c.filename,
+			Inode:   c.inode,
+			Time:    ts,
+			Summary: c.summary,
+		}}
+	}
+
+	records := make([]*jsonRecord, 0, len(c.lines))
+	for _, l := range c.lines {
+		r := &jsonRecord{
+			Type:  "line",
+			File:  c.filename,
+			Inode: c.inode,
+			Time:  ts,
+		}
+
+		if l.separator {
+			r.Type = "separator"
+			records = append(records, r)
+			continue
+		}
+
+		offset := l.offset
+		text := l.text
+		r.Offset = &offset
+		r.LineNo = l.lineNo
+		r.Line = &text
+		r.Level = levelLabel(l.level)
+		if l.record != nil {
+			r.Fields = json.RawMessage((&JSONRenderer{}).render(l.record, nil, nil))
+		}
+		r.Context = l.context
+
+		// json.Marshal replaces invalid UTF-8, keep the original bytes
+		// around so nothing is lost
+		if !utf8.ValidString(l.text) {
+			r.Raw = base64.StdEncoding.EncodeToString([]byte(l.text))
+		}
+
+		records = append(records, r)
+	}
+
+	return records
+}
+
+// writeJSON writes a single json record, followed by a new line
+func (p *ContentPrinter) writeJSON(r *jsonRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		debug(fmt.Sprintf("printer: error while marshalling json: %s", err))
+		return
+	}
+
+	_, _ = fmt.Fprintln(p.out, string(b))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// log levels, ordered by severity
+const (
+	LEVEL_TRACE = iota + 1
+	LEVEL_DEBUG
+	LEVEL_INFO
+	LEVEL_NOTICE
+	LEVEL_WARN
+	LEVEL_ERROR
+	LEVEL_CRIT
+	LEVEL_ALERT
+	LEVEL_FATAL
+)
+
+var (
+	// names the log levels are known by
+	levelNames = map[string]int{
+		"trace":         LEVEL_TRACE,
+		"trc":           LEVEL_TRACE,
+		"debug":         LEVEL_DEBUG,
+		"dbg":           LEVEL_DEBUG,
+		"dbug":          LEVEL_DEBUG,
+		"info":          LEVEL_INFO,
+		"inf":           LEVEL_INFO,
+		"information":   LEVEL_INFO,
+		"informational": LEVEL_INFO,
+		"notice":        LEVEL_NOTICE,
+		"warn":          LEVEL_WARN,
+		"warning":       LEVEL_WARN,
+		"wrn":           LEVEL_WARN,
+		"error":         LEVEL_ERROR,
+		"err":           LEVEL_ERROR,
+		"eror":          LEVEL_ERROR,
+		"crit":          LEVEL_CRIT,
+		"critical":      LEVEL_CRIT,
+		"alert":         LEVEL_ALERT,
+		"fatal":         LEVEL_FATAL,
+		"panic":         LEVEL_FATAL,
+		"emerg":         LEVEL_FATAL,
+		"emergency":     LEVEL_FATAL,
+	}
+
+	// level names colored by levelStyle, along with the names starting
+	// with them
+	coloredLevels = map[string]int{
+		"fatal": LEVEL_FATAL,
+		"panic": LEVEL_FATAL,
+		"crit":  LEVEL_CRIT,
+		"error": LEVEL_ERROR,
+		"err":   LEVEL_ERROR,
+		"warn":  LEVEL_WARN,
+		"info":  LEVEL_INFO,
+		"debug": LEVEL_DEBUG,
+		"trace": LEVEL_TRACE,
+	}
+
+	// colors of the log levels
+	levelStyles = map[int]Style{
+		LEVEL_TRACE:  mustStyle("dim"),
+		LEVEL_DEBUG:  mustStyle("blue"),
+		LEVEL_INFO:   mustStyle("green"),
+		LEVEL_NOTICE: mustStyle("cyan"),
+		LEVEL_WARN:   mustStyle("bold", "yellow"),
+		LEVEL_ERROR:  mustStyle("bold", "red"),
+		LEVEL_CRIT:   mustStyle("bold", "red"),
+		LEVEL_ALERT:  mustStyle("bold", "bg-red", "white"),
+		LEVEL_FATAL:  mustStyle("bold", "bg-red", "white"),
+	}
+
+	// names of the levels when printed
+	levelLabels = map[int]string{
+		LEVEL_TRACE:  "trace",
+		LEVEL_DEBUG:  "debug",
+		LEVEL_INFO:   "info",
+		LEVEL_NOTICE: "notice",
+		LEVEL_WARN:   "warn",
+		LEVEL_ERROR:  "error",
+		LEVEL_CRIT:   "crit",
+		LEVEL_ALERT:  "alert",
+		LEVEL_FATAL:  "fatal",
+	}
+
+	// single letter levels, ie: [E], or E0601 in glog
+	levelLetters = map[string]int{
+		"t": LEVEL_TRACE,
+		"d": LEVEL_DEBUG,
+		"i": LEVEL_INFO,
+		"n": LEVEL_NOTICE,
+		"w": LEVEL_WARN,
+		"e": LEVEL_ERROR,
+		"c": LEVEL_CRIT,
+		"a": LEVEL_ALERT,
+		"f": LEVEL_FATAL,
+	}
+
+	// syslog severities, by their number
+	syslogSeverities = []int{
+		LEVEL_FATAL, LEVEL_ALERT, LEVEL_CRIT, LEVEL_ERROR,
+		LEVEL_WARN, LEVEL_NOTICE, LEVEL_INFO, LEVEL_DEBUG,
+	}
+
+	// levels in plain text, the leftmost match wins
+	//   <3>           syslog priority at the start of the line
+	//   [E] E0601     single letters, bracketed or glog style
+	//   [error]       bracketed names in any case
+	//   ERROR WARN    upper case words
+	//   level=error   key=value pairs within text
+	textLevelPattern = regexp.MustCompile(
+		`^<(\d{1,3})>` +
+			`|(?:\[([TDINWECAFtdinwecaf])\]|^([IWEF])\d{4} )` +
+			`|\[(?i:(trace|debug|info|notice|warn(?:ing)?|error|err|crit(?:ical)?|alert|fatal|panic|emerg))\]` +
+			`|\b(TRACE|DEBUG|INFO|NOTICE|WARN(?:ING)?|ERROR|ERR|CRIT(?:ICAL)?|ALERT|FATAL|PANIC|EMERG)\b` +
+			`|\b(?i:level|lvl|severity)[=:]\s*"?(\w+)`)
+)
+
+// parseLevel returns the severity of the given level name
+// Returns false if the name isn't a known level
+func parseLevel(name string) (int, bool) {
+	l, ok := levelNames[strings.ToLower(strings.TrimSpace(name))]
+	return l, ok
+}
+
+// levelStyle returns the color of the given level name, or of the level
+// it starts with, ie: ERROR: or warnings. No style if it's not a colored
+// level
+func levelStyle(name string) Style {
+	l := strings.ToLower(strings.TrimSpace(name))
+	for prefix, level := range coloredLevels {
+		if strings.HasPrefix(l, prefix) {
+			return levelStyles[level]
+		}
+	}
+
+	return Style{}
+}
+
+// levelLabel returns the name of the given level, empty if unknown
+func levelLabel(l int) string {
+	return levelLabels[l]
+}
+
+// LevelDetector finds the level of a line
+type LevelDetector interface {
+	// detect returns the level of the line, or false if it can't tell
+	detect(l *Line) (int, bool)
+}
+
+// newLevelDetector creates the named LevelDetector, one of
+//
+//	auto         the level field of structured lines, then the text
+//	fields       only the level field of structured lines
+//	text         only the text of the line
+//	regex:<re>   the first group of the expression, or the whole match
+//	none         no detection
+//
+// Returns nil for none
+func newLevelDetector(name string, levelKeys []string) (LevelDetector, error) {
+	switch {
+	case name == "none":
+		return nil, nil
+	case name == "auto":
+		return levelDetectors{&fieldLevelDetector{keys: levelKeys}, &textLevelDetector{}}, nil
+	case name == "fields":
+		return &fieldLevelDetector{keys: levelKeys}, nil
+	case name == "text":
+		return &textLevelDetector{}, nil
+	case strings.HasPrefix(name, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(name, "regex:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level expression: %s", err)
+		}
+
+		return &regexLevelDetector{re: re}, nil
+	}
+
+	return nil, fmt.Errorf("unknown level detector %s", name)
+}
+
+// levelDetectors tries each detector in order until one finds a level
+type levelDetectors []LevelDetector
+
+func (d levelDetectors) detect(l *Line) (int, bool) {
+	for _, detector := range d {
+		if lvl, ok := detector.detect(l); ok {
+			return lvl, true
+		}
+	}
+
+	return 0, false
+}
+
+// fieldLevelDetector reads the level field of structured lines. Besides
+// level names, syslog severities (0-7) and bunyan/pino levels (10-60)
+// are understood.
+type fieldLevelDetector struct {
+	keys []string
+}
+
+func (d *fieldLevelDetector) detect(l *Line) (int, bool) {
+	if l.record == nil {
+		return 0, false
+	}
+
+	// requests are leveled by their status
+	if l.record.Format == "access" {
+		status, ok := l.record.get("status")
+		return statusLevel(status), ok
+	}
+
+	_, v, ok := l.record.first(d.keys)
+	if !ok {
+		return 0, false
+	}
+
+	if lvl, ok := parseLevel(v); ok {
+		return lvl, true
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+
+	switch {
+	case n >= 0 && n < len(syslogSeverities):
+		return syslogSeverities[n], true
+	case n >= 10 && n <= 60 && n%10 == 0:
+		return []int{LEVEL_TRACE, LEVEL_DEBUG, LEVEL_INFO, LEVEL_WARN, LEVEL_ERROR, LEVEL_FATAL}[n/10-1], true
+	}
+
+	return 0, false
+}
+
+// textLevelDetector looks for level names, letters and syslog
+// priorities in the text of a line
+type textLevelDetector struct{}
+
+func (d *textLevelDetector) detect(l *Line) (int, bool) {
+	m := textLevelPattern.FindStringSubmatch(l.text)
+	if m == nil {
+		return 0, false
+	}
+
+	switch {
+	case m[1] != "":
+		// syslog priority, facility * 8 + severity
+		pri, _ := strconv.Atoi(m[1])
+		return syslogSeverities[pri%8], true
+	case m[2] != "":
+		return levelLetters[strings.ToLower(m[2])], true
+	case m[3] != "":
+		return levelLetters[strings.ToLower(m[3])], true
+	}
+
+	for _, g := range m[4:] {
+		if g != "" {
+			return parseLevel(g)
+		}
+	}
+
+	return 0, false
+}
+
+// regexLevelDetector reads the level out of a user given expression
+type regexLevelDetector struct {
+	re *regexp.Regexp
+}
+
+func (d *regexLevelDetector) detect(l *Line) (int, bool) {
+	m := d.re.FindStringSubmatch(l.text)
+	if m == nil {
+		return 0, false
+	}
+
+	name := m[0]
+	if len(m) > 1 {
+		name = m[1]
+	}
+
+	if lvl, ok := levelLetters[strings.ToLower(name)]; ok {
+		return lvl, true
+	}
+
+	return parseLevel(name)
+}
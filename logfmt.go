@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// logfmtParser parses lines of key=value pairs, ie:
+// ts=2019-06-01T10:00:00Z level=info msg="server started" port=8080
+type logfmtParser struct{}
+
+func (p *logfmtParser) parse(line string) (*Record, bool) {
+	fields, ok := parseLogfmt(line)
+	if !ok {
+		return nil, false
+	}
+
+	return &Record{Format: "logfmt", Fields: fields}, true
+}
+
+// parseLogfmt splits the given line into its key=value pairs. Values can
+// be quoted, with Go escapes inside the quotes. Every pair needs an
+// equal sign, otherwise any line of plain words would pass as logfmt.
+// Returns false if the line isn't logfmt
+func parseLogfmt(line string) ([]Field, bool) {
+	fields := make([]Field, 0)
+
+	i := 0
+	for {
+		// skip the spaces between pairs
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+
+		if i >= len(line) {
+			break
+		}
+
+		// the key runs up to the equal sign
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' && line[i] != '"' {
+			i++
+		}
+
+		if i == start || i >= len(line) || line[i] != '=' {
+			return nil, false
+		}
+
+		key := line[start:i]
+		i++
+
+		// an empty value
+		if i >= len(line) || line[i] == ' ' || line[i] == '\t' {
+			fields = append(fields, Field{Key: key})
+			continue
+		}
+
+		if line[i] == '"' {
+			end, ok := quotedEnd(line, i)
+			if !ok {
+				return nil, false
+			}
+
+			v, err := strconv.Unquote(line[i:end])
+			if err != nil {
+				return nil, false
+			}
+
+			// pairs are separated by spaces
+			if end < len(line) && line[end] != ' ' && line[end] != '\t' {
+				return nil, false
+			}
+
+			fields = append(fields, Field{Key: key, Value: v})
+			i = end
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			if line[i] == '"' || line[i] == '=' {
+				return nil, false
+			}
+			i++
+		}
+
+		v := line[start:i]
+		fields = append(fields, Field{Key: key, Value: v, Literal: isLiteral(v)})
+	}
+
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// quotedEnd returns the position right after the closing quote of the
+// quoted string starting at i
+func quotedEnd(s string, i int) (int, bool) {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// isLiteral checks if an unquoted value is a number, a bool or null, so
+// that it can be converted to json as is
+func isLiteral(v string) bool {
+	switch v {
+	case "true", "false", "null":
+		return true
+	}
+
+	var n json.Number
+	return json.Unmarshal([]byte(v), &n) == nil
+}
+
+// LogfmtRenderer prints records as logfmt, with colored keys and level
+type LogfmtRenderer struct {
+	levelKeys []string
+}
+
+func (l *LogfmtRenderer) render(r *Record, clean func(string) string, mark func(string) string) string {
+	pairs := make([]string, 0, len(r.Fields))
+	for _, f := range r.Fields {
+		// json objects and arrays have to be quoted to be read back
+		literal := f.Literal && !strings.HasPrefix(f.Value, "{") && !strings.HasPrefix(f.Value, "[")
+		v := quoteValue(clean(f.Value), literal)
+		if isLevelKey(f.Key, l.levelKeys) {
+			v = levelStyle(f.Value).apply(v)
+		} else if f.Key == "status" && r.Format == "access" {
+			v = levelStyles[statusLevel(f.Value)].apply(v)
+		} else {
+			v = mark(v)
+		}
+
+		pairs = append(pairs, keyStyle.apply(clean(f.Key)+"=")+v)
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// isLevelKey checks if the given key holds the level of a line
+func isLevelKey(key string, levelKeys []string) bool {
+	for _, k := range levelKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func FuzzParseLogfmt(f *testing.F) {
+	seeds := []string{
+		`ts=2019-06-01T10:00:00Z level=info msg="server started" port=8080`,
+		`a= b="" c="with \"quotes\" and \\ slashes"`,
+		`n=1.5e3 ok=true none=null obj="{\"a\":1}"`,
+		"tab=\"a\\tb\"\tnl=\"a\\nb\"",
+		`plain words`,
+		`k="unterminated`,
+		`=value`,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	// the keys aren't colored, so the rendered line can be parsed back
+	old := keyStyle
+	keyStyle = Style{}
+	f.Cleanup(func() { keyStyle = old })
+	renderer := &LogfmtRenderer{}
+	same := func(s string) string { return s }
+
+	f.Fuzz(func(t *testing.T, line string) {
+		fields, ok := parseLogfmt(line)
+		if !ok {
+			return
+		}
+
+		out := renderer.render(&Record{Format: "logfmt", Fields: fields}, same, same)
+		again, ok := parseLogfmt(out)
+		if !ok {
+			t.Fatalf("couldn't parse the rendered %q of %q", out, line)
+		}
+
+		if len(again) != len(fields) {
+			t.Fatalf("%q rendered as %q has %d fields, expected %d", line, out, len(again), len(fields))
+		}
+
+		for i := range fields {
+			if again[i].Key != fields[i].Key || again[i].Value != fields[i].Value {
+				t.Fatalf("%q rendered as %q: field %d is %q=%q, expected %q=%q",
+					line, out, i, again[i].Key, again[i].Value, fields[i].Key, fields[i].Value)
+			}
+		}
+	})
+}
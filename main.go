@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -39,8 +41,15 @@ var (
 
 func main() {
 	debug("main: processing input")
-	// line count to start with
-	var lcount int
+
+	// set when tailing ends because of a line, or a timeout. Exiting
+	// last, after the other defers are run
+	exitCode := EXIT_OK
+	defer func() {
+		if exitCode != EXIT_OK {
+			os.Exit(exitCode)
+		}
+	}()
 
 	// args without bin name
 	if len(os.Args) == 1 {
@@ -48,46 +57,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	args := os.Args[1:]
-
-	// list of files to tail
-	files := make([]string, 0)
-
 	// parse arguments
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "-") {
-			// one of init count, help, or version
-
-			// is it the help flag
-			if arg == "-h" || arg == "--help" {
-				showUsage()
-				os.Exit(0)
-			}
-
-			// is it the version flag
-			if arg == "-v" || arg == "--version" {
-				showVersion()
-				os.Exit(0)
-			}
-
-			// is it the line count flag
-			lc, err := readLineCountArg(arg)
-			handleErrorAndExit(err, fmt.Sprintf("unknown flag: %s", arg))
-
-			// it is the line count flag
-			lcount = lc
-		} else {
-			// should be either a single file name, multiple filenames or a file pattern
-			fname, err := parseFileName(arg)
-			if err != nil {
-				printErr(fmt.Sprintf("file not found: %s", arg))
-				showUsage()
-				os.Exit(0)
-			}
-
-			files = append(files, fname)
-		}
-	}
+	opts := parseArgs(os.Args[1:])
+	files := opts.files
+	// line count to start with
+	lcount := opts.lineCount
 
 	// if there are no files to tail, exit
 	if len(files) == 0 {
@@ -102,6 +76,17 @@ func main() {
 			"max file limit is 5, would be too much information for ya")
 	}
 
+	// context lines around filter matches
+	before := opts.before
+	if before < 0 {
+		before = 0
+	}
+
+	after := opts.after
+	if after < 0 {
+		after = 0
+	}
+
 	// if no tail count is provided, set default tail count to 5,
 	// awkward otherwise
 	if lcount == 0 {
@@ -114,6 +99,9 @@ func main() {
 	events := make(chan syscall.InotifyEvent)
 	// channel to pass read content from tailer to printer
 	content := make(chan *PrintContent)
+	// the printer tells the exit code through this channel once it
+	// printed the line ending tailing
+	quit := make(chan int, 1)
 
 	debug("main: registering signal trap")
 	// channels to trap signals
@@ -133,13 +121,204 @@ func main() {
 		debug("sig: sent message to shutdown")
 	}()
 
-	// start printer early
+	// content is made safe for terminals unless told otherwise
+	sanitizer, err := newSanitizer(opts.sanitize, opts.ansi)
+	handleErrorAndExit(err, "invalid sanitize options")
+
+	highlights, err := newHighlightRules(opts.highlights, opts.presets)
+	handleErrorAndExit(err, "invalid highlight rule")
+
+	// the filename is prefixed on the line printing if there are
+	// multiple files, unless a template is given
+	tmpl := opts.template
+	if tmpl == "" {
+		tmpl = DEFAULT_TEMPLATE
+		if len(files) > 1 {
+			tmpl = DEFAULT_MULTI_FILE_TEMPLATE
+		}
+	}
+
+	lineTemplate, err := newLineTemplate(tmpl)
+	handleErrorAndExit(err, "invalid template")
+
+	// relative timestamps are counted from here
+	startedAt := time.Now()
+
 	printer := &ContentPrinter{
-		// this flag determines if the filename is prefixed on the line
-		// printing
-		multiFile: len(files) > 1,
+		template:   lineTemplate,
+		output:     opts.output,
+		sanitizer:  sanitizer,
+		highlights: highlights,
+		out:        bufio.NewWriter(os.Stdout),
+	}
+
+	levelKeys := splitList(opts.levelKeys, DEFAULT_LEVEL_KEYS)
+	if opts.render != "" {
+		renderer, err := newRenderer(opts.render, levelKeys)
+		handleErrorAndExit(err, "invalid render flag")
+
+		if pretty, ok := renderer.(*PrettyRenderer); ok {
+			pretty.header = splitList(opts.header, pretty.header)
+			pretty.timeKeys = splitList(opts.timeKeys, DEFAULT_TIME_KEYS)
+			pretty.levelKeys = levelKeys
+			pretty.msgKeys = splitList(opts.msgKeys, DEFAULT_MSG_KEYS)
+		}
+
+		printer.renderer = renderer
+		printer.fields = splitList(opts.fields, nil)
+	}
+
+	// lines are colored by level when printed to a terminal
+	printer.levelColors = opts.levelColors == "always" ||
+		(opts.levelColors == "auto" && isTerminal(os.Stdout))
+
+	if opts.timestamps {
+		printer.timestamps = newTimestamper(opts.timestampFormat, startedAt)
+	}
+
+	// how fast the files grow is printed every now and then, and a
+	// summary once the lines left are printed
+	var fileStats *FileStats
+	if opts.stats > 0 {
+		fileStats = newFileStats()
+		defer fileStats.summary()
+	}
+
+	// the contents are written to the terminal and to the other sinks,
+	// each at its own pace
+	fanout := newFanout(quit)
+	fanout.add("printer", printer, true)
+
+	// the printed lines are forwarded to a syslog server as well, buffered
+	// in memory or on disk while it's down
+	var forwarder *Forwarder
+	if opts.forward != "" {
+		var buffer ForwardBuffer = newMemoryBuffer(opts.forwardBuffer)
+		if opts.forwardSpool != "" {
+			buffer, err = newDiskBuffer(opts.forwardSpool)
+			handleErrorAndExit(err, "couldn't open the forward spool")
+		}
+
+		forwarder, err = newForwarder(opts.forward, opts.forwardCA, buffer)
+		handleErrorAndExit(err, "invalid forward flag")
+
+		// the lines are sent as the app, the name of the file by default
+		for _, fname := range files {
+			app := opts.valueFor(opts.forwardApps, fname, "")
+			if app != "" && !validSyslogName(app, FORWARD_MAX_APP) {
+				handleErrorAndExit(
+					fmt.Errorf("%s has to be up to %d printable ascii characters, without spaces", app, FORWARD_MAX_APP),
+					"invalid forward app flag")
+			}
+
+			if app == "" {
+				app = filepath.Base(fname)
+			}
+			forwarder.setApp(fname, app)
+		}
+
+		go forwarder.start()
+		fanout.add("forward", forwarder, false)
+	}
+
+	// the counters of the files are served to prometheus, on their own
+	// or along with the lines
+	var metrics *Metrics
+	if opts.metrics != "" || opts.serve != "" {
+		metrics = &Metrics{}
+	}
+
+	if opts.metrics != "" {
+		listener, err := listenLocal(opts.metrics)
+		handleErrorAndExit(err, "couldn't serve the metrics on "+opts.metrics)
+
+		go metrics.start(listener)
+	}
+
+	// the printed lines are streamed to http clients too
+	var server *Server
+	if opts.serve != "" {
+		server, err = newServer(opts.serve, files, levelKeys, opts.serveBacklog)
+		handleErrorAndExit(err, "couldn't serve on "+opts.serve)
+		server.metrics = metrics
+
+		go server.start()
+		fanout.add("server", server, false)
+	}
+
+	// what's shown is saved to a file too, without colors
+	if opts.tee != "" {
+		file, err := newRotatingFile(opts.tee, opts.teeMaxSize, opts.teeRotate, opts.teeCompress, opts.teeKeep)
+		handleErrorAndExit(err, "couldn't open the tee file")
+
+		tee := newTeeSink(printer, file)
+		if opts.timestamps {
+			tee.printer.timestamps = newTimestamper(opts.timestampFormat, startedAt)
+		}
+		// like the terminal, no line of it is dropped
+		fanout.add("tee", tee, true)
+	}
+
+	for _, spec := range opts.sinks {
+		sink, err := newSink(spec)
+		handleErrorAndExit(err, "invalid sink flag")
+
+		fanout.add(spec, sink, false)
+	}
+
+	go fanout.start(content, done)
+	defer fanout.close()
+
+	// with --merge, the lines of the files are put in order before they
+	// are printed
+	tailed := content
+	var merger *Merger
+	var backlog []*PrintContent
+	if opts.merge {
+		tailed = make(chan *PrintContent)
+		merger = newMerger(opts.mergeWindow, splitList(opts.timeKeys, DEFAULT_TIME_KEYS), fanout)
+	}
+
+	// commands are run on matching lines, sharing the limits
+	var executor *Executor
+	if len(opts.execs) > 0 {
+		var execLog io.Writer
+		switch opts.execLog {
+		case "":
+		case "-":
+			execLog = os.Stderr
+		default:
+			f, err := os.OpenFile(opts.execLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			handleErrorAndExit(err, "couldn't open the exec log")
+
+			execLog = f
+		}
+
+		executor = newExecutor(opts.execConcurrency, opts.execTimeout, opts.execDebounce, execLog)
+	}
+
+	// alerts are posted to the webhook
+	var notifier *Notifier
+	if len(opts.alerts) > 0 {
+		if opts.webhook == "" {
+			handleErrorAndExit(errors.New("no --webhook to send them to"), "invalid alert flag")
+		}
+
+		notifier, err = newNotifier(opts.webhook, opts.webhookHeaders, opts.webhookTemplate)
+		handleErrorAndExit(err, "invalid webhook flag")
+
+		notifier.batch = opts.webhookBatch
+		notifier.retries = opts.webhookRetries
+		go notifier.start(done)
+		defer notifier.close()
+	}
+
+	// sum up the requests of access logs every now and then
+	var stats *AccessStats
+	if opts.summary > 0 {
+		stats = &AccessStats{}
+		go stats.start(opts.summary, content)
 	}
-	go printer.start(content, done)
 
 	// start an Inotify event reader loop
 	// though there are no consumers at this point, the events will be
@@ -158,6 +337,9 @@ func main() {
 		debug("defer: done")
 	}()
 
+	// rules for more files are a single rule
+	metricRules := make(map[string]*MetricRule)
+
 	// for each filename given,
 	// 1. register an inotify watch
 	// 2. spawn an event consumer
@@ -165,13 +347,104 @@ func main() {
 		debug(fmt.Sprintf("main: registering tailer for %s", fname))
 
 		// create a worker
-		t := newFileTailer(eventReader.fd, fname, content, outputColors[i])
+		t := newFileTailer(eventReader.fd, fname, tailed, outputColors[i])
+
+		// json output carries line numbers, templates might use them
+		execs := opts.valuesFor(opts.execs, fname)
+		alerts := opts.valuesFor(opts.alerts, fname)
+		t.lineNumbers = opts.output == OUTPUT_JSON || opts.serve != "" || strings.Contains(tmpl, ".LineNo") ||
+			len(execs) > 0 || len(alerts) > 0
+
+		// decode the content from the encoding given for the file
+		enc, _ := newEncoding(opts.valueFor(opts.encodings, fname, "auto"))
+		t.setEncoding(enc, opts.crlf)
+
+		// extract the fields of structured lines
+		// filtering by app needs the lines parsed as syslog
+		apps := opts.valuesFor(opts.apps, fname)
+		format := opts.valueFor(opts.formats, fname, "")
+		if format == "" && len(apps) > 0 {
+			format = "syslog"
+		}
+
+		if format != "" {
+			t.parser, _ = newParser(format)
+		}
+
+		// find the level of the lines if it's shown or filtered by
+		minLevel, _ := parseLevel(opts.valueFor(opts.levels, fname, ""))
+		if minLevel > 0 || printer.levelColors || forwarder != nil || server != nil || opts.output == OUTPUT_JSON || strings.Contains(tmpl, ".Level") {
+			t.levelDetector, _ = newLevelDetector(opts.valueFor(opts.levelDetectors, fname, "auto"), levelKeys)
+		}
+
+		// only show the lines matching the filters given for the file
+		t.filter, err = newLineFilter(
+			opts.valuesFor(opts.match, fname),
+			opts.valuesFor(opts.imatch, fname),
+			opts.valuesFor(opts.exclude, fname),
+			opts.valuesFor(opts.iexclude, fname))
+		handleErrorAndExit(err, fmt.Sprintf("invalid filter for %s", filepath.Base(fname)))
+
+		t.filter, err = t.filter.addQueries(opts.valuesFor(opts.where, fname), levelKeys)
+		handleErrorAndExit(err, fmt.Sprintf("invalid where query for %s", filepath.Base(fname)))
+
+		t.filter = t.filter.addApps(apps).setMinLevel(minLevel)
+
+		// notify of the lines matching the alert rules, armed after the
+		// first lines are read as well
+		alertRules := make([]*AlertRule, 0, len(alerts))
+		for _, a := range alerts {
+			r, err := newAlertRule(a)
+			handleErrorAndExit(err, fmt.Sprintf("invalid alert rule for %s", filepath.Base(fname)))
+
+			alertRules = append(alertRules, r)
+		}
+
+		// count the lines matching the metric rules
+		if metrics != nil {
+			for _, spec := range opts.valuesFor(opts.metricRules, fname) {
+				r, ok := metricRules[spec]
+				if !ok {
+					r, err = newMetricRule(spec)
+					handleErrorAndExit(err, fmt.Sprintf("invalid metric rule for %s", filepath.Base(fname)))
+
+					metricRules[spec] = r
+					metrics.addRules([]*MetricRule{r})
+				}
+
+				t.metricRules = append(t.metricRules, r)
+			}
+
+			metrics.addFile(t.metrics)
+		}
+
+		if fileStats != nil {
+			fileStats.addFile(t.metrics)
+		}
+
+		// tailing ends when one of these shows up
+		t.exitWatch, err = newExitWatch(opts.valuesFor(opts.until, fname), opts.valuesFor(opts.failOn, fname))
+		handleErrorAndExit(err, fmt.Sprintf("invalid until or fail on expression for %s", filepath.Base(fname)))
+
+		// commands to run on matches, armed after the first lines are read
+		rules := make([]*ExecRule, 0, len(execs))
+		for _, e := range execs {
+			r, err := executor.newExecRule(e)
+			handleErrorAndExit(err, fmt.Sprintf("invalid exec rule for %s", filepath.Base(fname)))
+
+			rules = append(rules, r)
+		}
+
+		// keep track of the lines around the matches to show them too
+		if t.filter != nil && (before > 0 || after > 0) {
+			t.context = newLineContext(before, after)
+		}
 
 		// create a file handler
 		t.openFile()
 
 		// start watching the file
-		err := t.registerWatch()
+		err = t.registerWatch()
 		// if the file can't be watched, crash and burn
 		if err != nil {
 			panic(err)
@@ -179,20 +452,91 @@ func main() {
 
 		dispatch.registerTailer(t.wd, t)
 
+		// lines before the first match are needed as its context
+		extra := 0
+		if t.context != nil {
+			extra = before
+		}
+
 		// if a line count is provided, rewind cursor
 		// the file should be read from the end, backwards
 		debug("tailing last lines")
-		seekBackwardsByLineCount(lcount, t.file)
+		seekBackwardsByLineCount(lcount, t.file, t.encoding, t.keepLine, extra)
+		t.countLines()
 
 		// read from the rewound position to EOF and queue to be
 		// printed
-		content <- t.readFile()
+		if merger != nil {
+			backlog = append(backlog, t.readFile())
+		} else {
+			content <- t.readFile()
+		}
+
+		// the lines shown at the start aren't new requests either
+		t.stats = stats
+		t.exec = rules
+		if len(alertRules) > 0 {
+			t.alerts = newAlerts(alertRules, notifier, opts.alertContext)
+		}
 	}
 
+	if merger != nil {
+		merger.mergeBacklog(backlog)
+		go merger.start(tailed, done)
+		defer merger.close()
+	}
+
+	if fileStats != nil {
+		fileStats.mark()
+		go fileStats.start(opts.stats, done)
+	}
+
+	// tailing ends early when a line says so, or on a timeout. The
+	// shutdown is the same as on a signal.
+	var timeout <-chan time.Time
+	if opts.timeout > 0 {
+		timeout = time.After(opts.timeout - time.Since(startedAt))
+	}
+
+	// closed once the exit code is decided
+	decided := make(chan struct{})
+
+	go func() {
+		defer close(decided)
+
+		select {
+		case exitCode = <-quit:
+			debug(fmt.Sprintf("main: tailing ended with %d", exitCode))
+		case <-timeout:
+			// only waiting for a line can time out
+			if len(opts.until) > 0 {
+				printErr(fmt.Sprintf("timed out after %s", opts.timeout))
+				exitCode = EXIT_TIMEOUT
+			}
+		case <-done:
+			// interrupted, or the files are gone
+			select {
+			case exitCode = <-quit:
+			default:
+				if len(opts.until) > 0 {
+					printErr("tailing ended before a line matched --until")
+					exitCode = EXIT_UNMATCHED
+				}
+			}
+			return
+		}
+
+		select {
+		case sigs <- syscall.SIGTERM:
+		default:
+		}
+	}()
+
 	dispatch.start(events, done)
 
 	// holding the main thread until shutdown
 	<-done
+	<-decided
 	debug("main: received notice to shutdown")
 }
 
@@ -230,6 +574,157 @@ func showUsage() {
 	printErr("Usage: tailf [OPTION]... [FILE]...")
 	printErr("A not so serious try at implementing tail -f in Go")
 	printErr("Why are you using this? Go back to tail.. Go!")
+	printErr("")
+	printErr("Options:")
+	printErr("  -<count>                  number of lines to start with, defaults to 5")
+	printErr("  --encoding [file:]<enc>   character encoding of the files, defaults to auto (BOM")
+	printErr("                            detection, UTF-8 otherwise). One of utf-8, utf-16,")
+	printErr("                            utf-16le, utf-16be, latin1, windows-1252, shift-jis,")
+	printErr("                            euc-jp")
+	printErr("  --crlf                    normalize CRLF line endings to LF")
+	printErr("  --match [file:]<regex>    only show lines matching the expression, can be")
+	printErr("                            repeated. Alias --grep")
+	printErr("  --exclude [file:]<regex>  hide lines matching the expression, can be repeated.")
+	printErr("                            Alias --grep-v")
+	printErr("  --imatch, --iexclude      same as --match and --exclude, ignoring case")
+	printErr("  --where [file:]<query>    only show structured lines whose fields match the")
+	printErr("                            query, ie: level>=warn && user_id==42 && took>500ms.")
+	printErr("                            Supports == != < <= > >= contains =~ !~ && || ! ( )")
+	printErr("  --level [file:]<level>    hide lines below the level, ie: warn. Lines of unknown")
+	printErr("                            level are shown")
+	printErr("  --level-detector [file:]<detector>")
+	printErr("                            how the level of a line is found, auto (default),")
+	printErr("                            fields, text, regex:<regex> or none")
+	printErr("  --level-colors <when>     color lines by their level, auto (default, when")
+	printErr("                            printing to a terminal), always or never")
+	printErr("  -A, --after-context <n>   show n lines after each filter match")
+	printErr("  -B, --before-context <n>  show n lines before each filter match")
+	printErr("  -C, --context <n>         show n lines before and after each filter match")
+	printErr("  -o, --output <format>     output format, text (default) or json. json prints an")
+	printErr("                            object per line, along with truncation, rotation and")
+	printErr("                            deletion events")
+	printErr("  --template <template>     Go text/template for each line of the text output.")
+	printErr("                            Fields: .File .Base .Line .LineNo .Offset .Time")
+	printErr("                            .Context .Level .Fields.<key>, .Color <string> colors")
+	printErr("                            with the file color.")
+	printErr("                            Functions: pad, lpad, trunc, ftime, style, upper, lower")
+	printErr("  --format [file:]<format>  parse the lines as a structured log format, one of")
+	printErr("                            json, logfmt, syslog, common, combined (access logs),")
+	printErr("                            nginx:<log_format> (ie: nginx:'$remote_addr")
+	printErr("                            \"$request\" $status $request_time'),")
+	printErr("                            grok:<expression> (ie: 'grok:%{LOGLEVEL:level}")
+	printErr("                            %{GREEDYDATA:msg}')")
+	printErr("  --grok-patterns <file>    file of grok patterns, a name and a pattern per line.")
+	printErr("                            Can be repeated")
+	printErr("  --render <renderer>       how the fields of structured lines are printed, one of")
+	printErr("                            pretty (a header followed by aligned key=value pairs),")
+	printErr("                            logfmt, json")
+	printErr("  --pretty                  same as --render pretty")
+	printErr("  --json                    same as --format json --render pretty")
+	printErr("  --logfmt                  same as --format logfmt --render logfmt")
+	printErr("  --syslog                  same as --format syslog")
+	printErr("  --alert [file:]<name>:<regex>")
+	printErr("                            post the shown lines matching the expression to the")
+	printErr("                            --webhook. Can be repeated")
+	printErr("  --alert-context <n>       lines before the match sent along, defaults to 3")
+	printErr("  --webhook <url>           url the alerts are posted to, as json")
+	printErr("  --webhook-header <header> header of the posts, ie: 'Authorization: Bearer x'.")
+	printErr("                            Can be repeated")
+	printErr("  --webhook-template <tmpl> template of the body of the posts, of .Host .Count")
+	printErr("                            .Alerts. json marshals a value")
+	printErr("  --webhook-batch <interval>")
+	printErr("                            alerts within the interval are sent together,")
+	printErr("                            defaults to 2s")
+	printErr("  --webhook-retries <n>     retries of failed posts, defaults to 3")
+	printErr("  --forward <url>           forward the shown lines to a syslog server, one of")
+	printErr("                            syslog://host[:514] (udp), syslog+tcp://host[:514],")
+	printErr("                            syslog+tls://host[:6514]")
+	printErr("  --forward-app [file:]<name>")
+	printErr("                            app name of the forwarded lines, defaults to the file")
+	printErr("                            name. Up to 48 printable ascii characters, no spaces")
+	printErr("  --forward-ca <file>       certificates to check the syslog+tls server with,")
+	printErr("                            instead of the system ones")
+	printErr("  --forward-buffer <n>      lines kept in memory while the server is down, the")
+	printErr("                            oldest ones are dropped. Defaults to 10000")
+	printErr("  --forward-spool <file>    keep the lines in the file while the server is down")
+	printErr("                            instead, sent on the next run if tailf exits first")
+	printErr("  --serve <addr>            stream the shown lines over http, ie: :8080 on the")
+	printErr("                            loopback interface only, 0.0.0.0:8080 on all. Serves a")
+	printErr("                            viewer on /, server-sent events on /events, a")
+	printErr("                            websocket on /ws and plain text on /stream, each")
+	printErr("                            taking match, imatch, exclude, iexclude, where, level,")
+	printErr("                            file and lines (to start with) query parameters")
+	printErr("  --serve-backlog <n>       last lines kept for new clients, defaults to 1000")
+	printErr("  --tee <file>              write the shown lines to the file too, without colors")
+	printErr("  --tee-max-size <size>     rotate the tee file once it's over the size, ie: 10M")
+	printErr("  --tee-rotate <interval>   rotate the tee file once it's open for the interval,")
+	printErr("                            ie: 1h")
+	printErr("  --tee-compress            gzip the rotated tee files")
+	printErr("  --tee-keep <n>            keep the n latest rotated tee files, all by default")
+	printErr("  --metrics <addr>          serve prometheus metrics on /metrics of the address,")
+	printErr("                            ie: :9100 on the loopback interface only, 0.0.0.0:9100")
+	printErr("                            on all. Also on /metrics of --serve")
+	printErr("  --metric [file:]<name>:<regex>")
+	printErr("                            count the lines matching the expression as the")
+	printErr("                            <name>_total metric, labeled by the file and the named")
+	printErr("                            groups. Can be repeated")
+	printErr("  --sink <sink>             write the shown lines to the sink too, a json object")
+	printErr("                            per line, one of file:<path> (appended to) or")
+	printErr("                            unix:<path> (a unix socket). Can be repeated")
+	printErr("  --until [file:]<regex>    stop tailing and exit with 0 once a line matches, with")
+	printErr("                            4 if tailing ends otherwise before that")
+	printErr("  --fail-on [file:]<regex>  stop tailing and exit with 2 once a line matches. Both")
+	printErr("                            check the lines shown at the start as well")
+	printErr("  --timeout <interval>      stop tailing after the interval, exiting with 3 if")
+	printErr("                            still waiting for an --until line")
+	printErr("  --exec-on-match [file:]<regex>=><command>")
+	printErr("                            run the command with sh -c when a shown line matches.")
+	printErr("                            The match is given as TAILF_LINE, TAILF_FILE,")
+	printErr("                            TAILF_MATCH, TAILF_GROUP_<n|name>... and the command")
+	printErr("                            is a template of .Line .File .Groups .Named...,")
+	printErr("                            the values shell quoted. Can be repeated")
+	printErr("  --exec-debounce <interval>")
+	printErr("                            don't run a rule again within the interval")
+	printErr("  --exec-concurrency <n>    max number of commands running at once, defaults to 4")
+	printErr("  --exec-timeout <interval> kill commands running longer, defaults to 30s")
+	printErr("  --exec-log <file>         append the output of the commands to the file, - for")
+	printErr("                            stderr")
+	printErr("  --merge                   print the lines of the files in the order of their")
+	printErr("                            timestamps")
+	printErr("  --merge-window <interval> how long live lines are held back to be put in order,")
+	printErr("                            defaults to 500ms")
+	printErr("  --summary <interval>      print a summary of the requests of access logs every")
+	printErr("                            interval, in seconds or as a duration (ie: 1m)")
+	printErr("  --stats <interval>        print the lines/s, bytes/s, lines, time since the last")
+	printErr("                            line and rotations of each file to stderr every")
+	printErr("                            interval, and a summary of them when tailing ends")
+	printErr("  --app [file:]<app>        only show syslog lines of the app, ie: sshd. Can be")
+	printErr("                            repeated")
+	printErr("  --fields <list>           comma separated fields to print, in order. End the list")
+	printErr("                            with ... to print the rest of the fields after them")
+	printErr("  --header <list>           comma separated header of --pretty, defaults to")
+	printErr("                            time,level,msg. Can also have any field key")
+	printErr("  --time-keys <list>        keys of the time field, defaults to")
+	printErr("                            time,ts,timestamp,@timestamp,t")
+	printErr("  --level-keys <list>       keys of the level field, defaults to")
+	printErr("                            level,severity,lvl,loglevel")
+	printErr("  --msg-keys <list>         keys of the message field, defaults to")
+	printErr("                            msg,message,text")
+	printErr("  --timestamps[=<format>]   prefix the lines with the time they were read. format")
+	printErr("                            is a Go time layout, rfc3339, rfc3339nano, time, unix,")
+	printErr("                            delta (since the previous line), or elapsed (since")
+	printErr("                            start)")
+	printErr("  --highlight [style:]<regex>")
+	printErr("                            style the matching parts of the lines, bold red by")
+	printErr("                            default. style is a comma separated list of bold, dim,")
+	printErr("                            italic, underline, reverse, <color>, bg-<color>")
+	printErr("  --highlight-preset <name> built in highlight rules, one of levels")
+	printErr("  --sanitize <mode>         escape control characters and invalid UTF-8, one of")
+	printErr("                            auto (default, only for terminals), always, never")
+	printErr("  --ansi <mode>             ANSI escape sequences in the content while sanitizing,")
+	printErr("                            one of escape (default), strip, pass")
+	printErr("  -h, --help                show this help")
+	printErr("  -v, --version             show version details")
 }
 
 // printErr prints the given message to stderr
@@ -259,80 +754,51 @@ func handleErrorAndExit(e error, msg string) {
 }
 
 // seekBackwardsByLineCount will move the read position of the passed
-// file until the specified line count from end is met
-// Returns the os.File reference which has a rewound cursor
-func seekBackwardsByLineCount(lc int, f *os.File) {
-	// line count counter
-	l := 0
-	// offset counter, negative because counting backwards
-	var offset int64 = -1
-
-	finfo, err := os.Stat(f.Name())
+// file until the specified line count from end is met. New lines are
+// searched for in the given encoding of the file. Only the lines keep
+// accepts are counted, nil counts all lines. extra lines before the
+// first counted line are included, to be shown as its context.
+func seekBackwardsByLineCount(lc int, f *os.File, enc *Encoding, keep func([]byte) bool, extra int) {
+	s, err := newBackwardScanner(f, enc)
 	if err != nil {
 		printErr(fmt.Sprintf("error while getting fileinfo: %s", f.Name()))
-		//return 0
+		return
 	}
 
-	fsize := finfo.Size()
-
-	if fsize == 0 {
-		debug("file has no content to show")
-		//return 0
-	}
-
-	// loop until lc is passed
-	for ; ; offset-- {
-		// check if we are past the file start
-		if offset+fsize == 0 {
-			// if so, return this position, there's no room to backup
+	// if the file is empty, or there aren't enough lines, the start
+	// of the content is used
+	offset := enc.bom
+	for l := 0; l < lc; {
+		line, off, ok := s.prev()
+		if !ok {
 			break
 		}
 
-		// seek backwards by offset from the end
-		p, err := f.Seek(int64(offset), io.SeekEnd)
-		if err != nil {
-			printErr(fmt.Sprintf("error while seeking by char at %d: %s", offset, err))
-			//return 0
+		if keep == nil || keep(line) {
+			l++
+			offset = off
 		}
+	}
 
-		// read one char, a new reader is needed from seeked File ref
-		buf := make([]byte, 1)
-		n, err := f.Read(buf)
-		if err != nil {
-			printErr(fmt.Sprintf("error while reading char at %d: %s", p, err))
-			//return 0
+	// only if the counted lines didn't reach the start of the file
+	for l := 0; l < extra; l++ {
+		_, off, ok := s.prev()
+		if !ok {
+			break
 		}
 
-		if n <= 0 {
-			printErr(fmt.Sprintf("no bytes read at %d: %s", p, err))
-			//return 0
-		}
+		offset = off
+	}
 
-		// check if read char is new line
-		s := string(buf)
-		if s == "\n" {
-			l++
-			// if line count is passed
-			if l > lc {
-				// increase the offset by one (to compensate for last
-				// read new line
-				offset++
-
-				// escape from loop
-				break
-			}
-		}
+	if s.err != nil {
+		printErr(fmt.Sprintf("error while reading backwards: %s", s.err))
 	}
 
 	// seek to the found position
-	_, err = f.Seek(int64(offset), io.SeekEnd)
+	_, err = f.Seek(offset, io.SeekStart)
 	if err != nil {
 		printErr(fmt.Sprintf("end: error while seeking by char at %d: %s", offset, err))
-		//return 0
 	}
-
-	// show the lines up to EOF
-	//return readContentToEOF(file)
 }
 
 // readLineCountArg parses the given string to a usable int value
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_MERGE_WINDOW is how long live lines are held back to be put in
+// order with the lines of the other files
+const DEFAULT_MERGE_WINDOW = 500 * time.Millisecond
+
+// timestamp formats looked for in lines, and how to read them
+var lineTimeFormats = []struct {
+	re      *regexp.Regexp
+	layouts []string
+}{
+	// 2019-06-01T10:00:00.123Z, 2019-06-01 10:00:00,123 +0200
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?: ?(?:Z|[+-]\d{2}:?\d{2}))?`),
+		[]string{"2006-01-02T15:04:05.999999999Z07:00", "2006-01-02T15:04:05.999999999Z0700",
+			"2006-01-02T15:04:05.999999999 Z07:00", "2006-01-02T15:04:05.999999999 Z0700",
+			"2006-01-02T15:04:05.999999999"}},
+	// 01/Jun/2019:10:00:00 +0200 of access logs
+	{regexp.MustCompile(`\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`),
+		[]string{"02/Jan/2006:15:04:05 -0700"}},
+	// 2019/06/01 10:00:00.123 of Go's log package
+	{regexp.MustCompile(`\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?`),
+		[]string{"2006/01/02 15:04:05.999999999"}},
+	// Jun  1 10:00:00 of syslog, without a year
+	{regexp.MustCompile(`[A-Z][a-z]{2} {1,2}\d{1,2} \d{2}:\d{2}:\d{2}`),
+		[]string{"Jan _2 15:04:05", "Jan 2 15:04:05"}},
+}
+
+// parseLineTime finds the first timestamp within the start of the text.
+// Returns false if there's none
+func parseLineTime(s string) (time.Time, bool) {
+	// timestamps are near the start of the line, if there's one
+	if len(s) > 64 {
+		s = s[:64]
+	}
+
+	var found time.Time
+	first := -1
+	for _, f := range lineTimeFormats {
+		loc := f.re.FindStringIndex(s)
+		if loc == nil || (first >= 0 && loc[0] >= first) {
+			continue
+		}
+
+		if t, ok := parseTimeLayouts(s[loc[0]:loc[1]], f.layouts); ok {
+			found, first = t, loc[0]
+		}
+	}
+
+	return found, first >= 0
+}
+
+// parseTimeLayouts reads the timestamp with the first layout that fits.
+// Times without a zone are local, and without a year in the current one.
+func parseTimeLayouts(v string, layouts []string) (time.Time, bool) {
+	// 2019-06-01 10:00:00,123 reads as 2019-06-01T10:00:00.123
+	if len(v) > 10 && v[10] == ' ' && v[4] == '-' {
+		v = v[:10] + "T" + v[11:]
+	}
+	v = strings.Replace(v, ",", ".", 1)
+
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, v, time.Local)
+		if err != nil {
+			continue
+		}
+
+		if t.Year() == 0 {
+			t = t.AddDate(time.Now().Year(), 0, 0)
+		}
+
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+// parseFieldTime reads the value of a time field, a timestamp or a unix
+// time in seconds or milliseconds
+func parseFieldTime(v string) (time.Time, bool) {
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		if f > 1e12 {
+			return time.Unix(0, int64(f*float64(time.Millisecond))), true
+		}
+
+		return time.Unix(0, int64(f*float64(time.Second))), true
+	}
+
+	for _, f := range lineTimeFormats {
+		if loc := f.re.FindStringIndex(v); loc != nil && loc[0] == 0 {
+			return parseTimeLayouts(v[:loc[1]], f.layouts)
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Merger puts the lines of several files in the order of their
+// timestamps before they are printed. Lines without a timestamp, like
+// the ones of a stack trace, take the time of the line before them.
+type Merger struct {
+	// how long live lines are held back for lines of other files that
+	// come before them
+	window time.Duration
+	// keys the time of structured lines is looked up with
+	timeKeys []string
+	// the lines are handed to the sinks as they're put in order, even
+	// once tailing ends
+	fanout *Fanout
+	// time of the last line of each file
+	last map[string]time.Time
+	// lines held back, and a counter to keep the order of lines of the
+	// same time
+	pending mergeHeap
+	seq     int
+	// closed once the held back lines are printed, after shutdown
+	finished chan struct{}
+}
+
+func newMerger(window time.Duration, timeKeys []string, fanout *Fanout) *Merger {
+	return &Merger{
+		window:   window,
+		timeKeys: timeKeys,
+		fanout:   fanout,
+		last:     make(map[string]time.Time),
+		finished: make(chan struct{}),
+	}
+}
+
+// mergeEntry is a line held back by the merger
+type mergeEntry struct {
+	time    time.Time
+	arrived time.Time
+	seq     int
+	line    *Line
+	// what the line came with
+	content *PrintContent
+}
+
+// mergeHeap orders the entries by time, and by arrival for the same time
+type mergeHeap []*mergeEntry
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].time.Equal(h[j].time) {
+		return h[i].time.Before(h[j].time)
+	}
+
+	return h[i].seq < h[j].seq
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeEntry)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// timeOf returns the time of the line, from its time field or its text,
+// or the time of the line before it in the file
+func (m *Merger) timeOf(c *PrintContent, l *Line) time.Time {
+	var t time.Time
+	ok := false
+	if l.record != nil {
+		if _, v, found := l.record.first(m.timeKeys); found {
+			t, ok = parseFieldTime(v)
+		}
+	}
+
+	if !ok && !l.separator {
+		t, ok = parseLineTime(l.text)
+	}
+
+	if !ok {
+		if last, seen := m.last[c.filename]; seen {
+			return last
+		}
+
+		// nothing to go by, the time it was read it is
+		t = c.readAt
+	}
+
+	m.last[c.filename] = t
+	return t
+}
+
+// entries returns the lines of the content as entries, with their time
+func (m *Merger) entries(c *PrintContent, arrived time.Time) []*mergeEntry {
+	entries := make([]*mergeEntry, 0, len(c.lines))
+	for _, l := range c.lines {
+		entries = append(entries, &mergeEntry{
+			time:    m.timeOf(c, l),
+			arrived: arrived,
+			seq:     m.seq,
+			line:    l,
+			content: c,
+		})
+		m.seq++
+	}
+
+	return entries
+}
+
+// mergeBacklog prints the first lines of the files in the order of their
+// time. The lines of each file are kept in the order they were read in,
+// and the files merged with a k-way merge.
+func (m *Merger) mergeBacklog(contents []*PrintContent) {
+	// the cursor of each file is the head of its remaining lines
+	files := make([][]*mergeEntry, 0, len(contents))
+	h := &mergeHeap{}
+	for _, c := range contents {
+		entries := m.entries(c, c.readAt)
+		if len(entries) == 0 {
+			continue
+		}
+
+		// the seq of the head points back to its file
+		head := *entries[0]
+		head.seq = len(files)
+		files = append(files, entries)
+		heap.Push(h, &head)
+	}
+
+	// tailing ends with a line of a file, the lines of the others that
+	// come after it aren't printed
+	var stop *PrintContent
+	for _, c := range contents {
+		if c.stop {
+			stop = c
+			break
+		}
+	}
+
+	merged := make([]*mergeEntry, 0)
+	for h.Len() > 0 {
+		head := heap.Pop(h).(*mergeEntry)
+		i := head.seq
+		merged = append(merged, files[i][0])
+
+		files[i] = files[i][1:]
+		if len(files[i]) > 0 {
+			next := *files[i][0]
+			next.seq = i
+			heap.Push(h, &next)
+		}
+	}
+
+	if stop == nil {
+		m.emit(merged)
+		return
+	}
+
+	m.emit(upToStop(merged, stop))
+	m.fanout.send(&PrintContent{stop: true, exitCode: stop.exitCode})
+}
+
+// upToStop returns the entries up to the last line of the content
+// tailing ends with, all of them if it has no lines
+func upToStop(entries []*mergeEntry, stop *PrintContent) []*mergeEntry {
+	if len(stop.lines) == 0 {
+		return entries
+	}
+
+	last := stop.lines[len(stop.lines)-1]
+	for i, e := range entries {
+		if e.line == last {
+			return entries[:i+1]
+		}
+	}
+
+	return entries
+}
+
+// start holds back the lines sent to it for the window, and prints them
+// in order. Events are passed on right away. The lines still held back
+// are printed on shutdown.
+func (m *Merger) start(in <-chan *PrintContent, done <-chan bool) {
+	defer close(m.finished)
+
+	tick := m.window / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-in:
+			if c.event != "" {
+				m.fanout.send(c)
+				continue
+			}
+
+			debug(fmt.Sprintf("merger: holding back %d lines of %s", len(c.lines), c.filename))
+			for _, e := range m.entries(c, time.Now()) {
+				heap.Push(&m.pending, e)
+			}
+
+			// tailing ends with these lines, nothing to wait for
+			if c.stop {
+				m.emit(upToStop(m.popAll(), c))
+				m.fanout.send(&PrintContent{stop: true, exitCode: c.exitCode})
+			}
+		case now := <-ticker.C:
+			m.flush(now.Add(-m.window))
+		case <-done:
+			debug("merger: received notice to shutdown")
+			m.emit(m.popAll())
+			return
+		}
+	}
+}
+
+// close waits for the held back lines to be printed, for as long as the
+// sinks are waited for
+func (m *Merger) close() {
+	select {
+	case <-m.finished:
+	case <-time.After(SINK_CLOSE_TIMEOUT):
+		debug("merger: gave up on printing the held back lines")
+	}
+}
+
+// popAll returns all the held back lines, in order
+func (m *Merger) popAll() []*mergeEntry {
+	entries := make([]*mergeEntry, 0, m.pending.Len())
+	for m.pending.Len() > 0 {
+		entries = append(entries, heap.Pop(&m.pending).(*mergeEntry))
+	}
+
+	return entries
+}
+
+// flush prints the held back lines, in order, up to the first one that
+// arrived after the cutoff
+func (m *Merger) flush(cutoff time.Time) {
+	ready := make([]*mergeEntry, 0)
+	for m.pending.Len() > 0 && !m.pending[0].arrived.After(cutoff) {
+		ready = append(ready, heap.Pop(&m.pending).(*mergeEntry))
+	}
+
+	m.emit(ready)
+}
+
+// emit sends the entries to the printer, the consecutive ones of the
+// same file together
+func (m *Merger) emit(entries []*mergeEntry) {
+	var c *PrintContent
+	for _, e := range entries {
+		if c == nil || c.filename != e.content.filename {
+			if c != nil {
+				m.fanout.send(c)
+			}
+
+			c = &PrintContent{
+				filename: e.content.filename,
+				color:    e.content.color,
+				inode:    e.content.inode,
+				readAt:   e.content.readAt,
+			}
+		}
+
+		c.lines = append(c.lines, e.line)
+	}
+
+	if c != nil {
+		m.fanout.send(c)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// inotify queue overflows seen, events were lost for all the files
+var inotifyOverflows int64
+
+// valid names of prometheus metrics and labels
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// FileMetrics counts what happens while tailing a file. The counters
+// are updated by the tailer and read from other goroutines.
+type FileMetrics struct {
+	// kept first, to be aligned for the atomic operations
+	lines   int64
+	bytes   int64
+	matched int64
+	// read position in the file, the lag is the size of the file past it
+	offset      int64
+	rotations   int64
+	truncations int64
+	deletions   int64
+	// when the last line was read, in unix nanoseconds
+	lastLine int64
+	name     string
+}
+
+func newFileMetrics(name string) *FileMetrics {
+	return &FileMetrics{name: name}
+}
+
+// read counts a read of n bytes, up to the offset
+func (m *FileMetrics) read(n int, offset int64) {
+	atomic.AddInt64(&m.bytes, int64(n))
+	atomic.StoreInt64(&m.offset, offset)
+}
+
+// line counts a line, and whether it matched the filter
+func (m *FileMetrics) line(matched bool, readAt int64) {
+	atomic.AddInt64(&m.lines, 1)
+	atomic.StoreInt64(&m.lastLine, readAt)
+	if matched {
+		atomic.AddInt64(&m.matched, 1)
+	}
+}
+
+// event counts an event of the file
+func (m *FileMetrics) event(e string) {
+	switch e {
+	case EVENT_ROTATED:
+		atomic.AddInt64(&m.rotations, 1)
+	case EVENT_TRUNCATED:
+		atomic.AddInt64(&m.truncations, 1)
+	case EVENT_DELETED:
+		atomic.AddInt64(&m.deletions, 1)
+	}
+}
+
+// lag returns how many bytes of the file are left to be read
+func (m *FileMetrics) lag() int64 {
+	info, err := os.Stat(m.name)
+	if err != nil {
+		return 0
+	}
+
+	lag := info.Size() - atomic.LoadInt64(&m.offset)
+	if lag < 0 {
+		return 0
+	}
+
+	return lag
+}
+
+// MetricRule counts the lines matching its expression. The named
+// groups of the expression label the counts.
+type MetricRule struct {
+	sync.Mutex
+	name string
+	re   *regexp.Regexp
+	// counts by file and the values of the named groups
+	counts map[string]int64
+	labels map[string][]string
+}
+
+// newMetricRule parses a <name>:<regex> rule, ie:
+// 'http_errors:status=(?P<status>5\d\d)'
+func newMetricRule(spec string) (*MetricRule, error) {
+	i := strings.Index(spec, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("missing the name of the metric %s, expected name:regex", spec)
+	}
+
+	name := spec[:i]
+	if !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	if !metricName.MatchString(name) {
+		return nil, fmt.Errorf("invalid metric name %s", spec[:i])
+	}
+
+	// the series of the files are named so
+	if strings.HasPrefix(name, "tailf_") {
+		return nil, fmt.Errorf("metric name %s can't start with tailf_", spec[:i])
+	}
+
+	re, err := regexp.Compile(spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %s: %s", spec[i+1:], err)
+	}
+
+	for _, g := range re.SubexpNames() {
+		if g != "" && (!labelName.MatchString(g) || g == "file" || strings.HasPrefix(g, "__")) {
+			return nil, fmt.Errorf("invalid label name %s", g)
+		}
+	}
+
+	return &MetricRule{
+		name:   name,
+		re:     re,
+		counts: make(map[string]int64),
+		labels: make(map[string][]string),
+	}, nil
+}
+
+// check counts the line if it matches
+func (r *MetricRule) check(fname string, l *Line) {
+	m := r.re.FindStringSubmatch(l.text)
+	if m == nil {
+		return
+	}
+
+	labels := []string{"file", fname}
+	for i, g := range r.re.SubexpNames() {
+		if g != "" {
+			labels = append(labels, g, m[i])
+		}
+	}
+
+	key := strings.Join(labels, "\x00")
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.labels[key]; !ok {
+		r.labels[key] = labels
+	}
+	r.counts[key]++
+}
+
+// Metrics exposes the counters of the files and the metric rules in the
+// prometheus text format
+type Metrics struct {
+	sync.Mutex
+	files []*FileMetrics
+	rules []*MetricRule
+}
+
+func (m *Metrics) addFile(f *FileMetrics) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.files = append(m.files, f)
+}
+
+func (m *Metrics) addRules(rules []*MetricRule) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.rules = append(m.rules, rules...)
+}
+
+// start serves the metrics on /metrics of the address, ie: :9100
+func (m *Metrics) start(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	debug(fmt.Sprintf("metrics: listening on %s", listener.Addr()))
+	if err := http.Serve(listener, mux); err != nil {
+		printErr(fmt.Sprintf("metrics: %s", err))
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// write writes all the metrics in the text exposition format
+func (m *Metrics) write(w io.Writer) {
+	m.Lock()
+	files := append([]*FileMetrics{}, m.files...)
+	rules := append([]*MetricRule{}, m.rules...)
+	m.Unlock()
+
+	fileCounters := []struct {
+		name  string
+		help  string
+		typ   string
+		value func(f *FileMetrics) int64
+	}{
+		{"tailf_lines_total", "Lines read from the file.", "counter",
+			func(f *FileMetrics) int64 { return atomic.LoadInt64(&f.lines) }},
+		{"tailf_bytes_total", "Bytes read from the file.", "counter",
+			func(f *FileMetrics) int64 { return atomic.LoadInt64(&f.bytes) }},
+		{"tailf_lines_matched_total", "Lines of the file matching the filters.", "counter",
+			func(f *FileMetrics) int64 { return atomic.LoadInt64(&f.matched) }},
+		{"tailf_rotations_total", "Times the file was rotated.", "counter",
+			func(f *FileMetrics) int64 { return atomic.LoadInt64(&f.rotations) }},
+		{"tailf_truncations_total", "Times the file was truncated.", "counter",
+			func(f *FileMetrics) int64 { return atomic.LoadInt64(&f.truncations) }},
+		{"tailf_deletions_total", "Times the file was deleted.", "counter",
+			func(f *FileMetrics) int64 { return atomic.LoadInt64(&f.deletions) }},
+		{"tailf_lag_bytes", "Bytes of the file not read yet.", "gauge",
+			func(f *FileMetrics) int64 { return f.lag() }},
+	}
+
+	for _, c := range fileCounters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.typ)
+		for _, f := range files {
+			fmt.Fprintf(w, "%s{file=\"%s\"} %d\n", c.name, escapeLabel(f.name), c.value(f))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP tailf_inotify_overflows_total Times inotify events were lost.\n")
+	fmt.Fprintf(w, "# TYPE tailf_inotify_overflows_total counter\n")
+	fmt.Fprintf(w, "tailf_inotify_overflows_total %d\n", atomic.LoadInt64(&inotifyOverflows))
+
+	// rules of the same name are a single metric, summed up
+	names := make([]string, 0)
+	byName := make(map[string][]*MetricRule)
+	for _, r := range rules {
+		if _, ok := byName[r.name]; !ok {
+			names = append(names, r.name)
+		}
+		byName[r.name] = append(byName[r.name], r)
+	}
+
+	for _, name := range names {
+		counts := make(map[string]int64)
+		labels := make(map[string][]string)
+		for _, r := range byName[name] {
+			r.Lock()
+			for k, n := range r.counts {
+				counts[k] += n
+				labels[k] = r.labels[k]
+			}
+			r.Unlock()
+		}
+
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, formatLabels(labels[k]), counts[k])
+		}
+	}
+}
+
+// formatLabels formats the name and value pairs of the labels of a
+// sample, ie: file="app.log",status="500"
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabel(labels[i+1])))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// escapeLabel escapes a label value of the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
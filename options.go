@@ -0,0 +1,736 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options collects what was given in the command line
+type options struct {
+	// line count to start with
+	lineCount int
+	// list of files to tail
+	files []string
+	// character encodings, optionally scoped to a file
+	encodings []string
+	// normalize CRLF line endings to LF
+	crlf bool
+	// when to escape control characters, auto, always or never
+	sanitize string
+	// what to do with ANSI escape sequences when sanitizing
+	ansi string
+	// line filters, optionally scoped to a file
+	match    []string
+	imatch   []string
+	exclude  []string
+	iexclude []string
+	// queries on the fields of structured lines, optionally scoped to a
+	// file
+	where []string
+	// apps of the syslog lines shown, optionally scoped to a file
+	apps []string
+	// lines of context shown before and after filter matches, -1 if
+	// not given
+	before int
+	after  int
+	// output format, text or json
+	output string
+	// template of each line in the text output
+	template string
+	// whether to prefix the lines with the time they were read, and
+	// the format to do so
+	timestamps      bool
+	timestampFormat string
+	// log formats the lines are parsed as, optionally scoped to a file
+	formats []string
+	// files of grok patterns
+	grokFiles []string
+	// how the fields of structured lines are printed, pretty, logfmt
+	// or json. Empty to print the lines as they are
+	render string
+	// what the header of the pretty lines is made of
+	header string
+	// fields to print, in order
+	fields string
+	// keys the time, level and message are looked up with
+	timeKeys  string
+	levelKeys string
+	msgKeys   string
+	// commands run on matching lines, optionally scoped to a file, and
+	// their limits
+	execs           []string
+	execConcurrency int
+	execTimeout     time.Duration
+	execDebounce    time.Duration
+	// where the output of the commands goes, empty to drop it
+	execLog string
+	// alert rules, optionally scoped to a file, and the webhook they are
+	// posted to
+	alerts          []string
+	alertContext    int
+	webhook         string
+	webhookHeaders  []string
+	webhookTemplate string
+	webhookBatch    time.Duration
+	webhookRetries  int
+	// syslog server the lines are forwarded to, the app name of the lines
+	// of each file, and where they wait while it's down
+	forward       string
+	forwardApps   []string
+	forwardCA     string
+	forwardBuffer int
+	forwardSpool  string
+	// address the lines are served over http on, and how many of the
+	// last lines are kept for new clients
+	serve        string
+	serveBacklog int
+	// file the shown lines are written to as well, and how it's rotated
+	tee         string
+	teeMaxSize  int64
+	teeRotate   time.Duration
+	teeCompress bool
+	teeKeep     int
+	// address the metrics are served on, and the rules counting lines,
+	// optionally scoped to a file
+	metrics     string
+	metricRules []string
+	// more sinks the lines are written to, ie: file:<path>
+	sinks []string
+	// tailing ends when a line matches, with success for the until
+	// expressions and failure for the fail on ones. Both are optionally
+	// scoped to a file
+	until  []string
+	failOn []string
+	// how long to tail for, 0 for ever
+	timeout time.Duration
+	// how often a summary of the access logs is printed, 0 for never
+	summary time.Duration
+	// how often the stats of the files are printed, 0 for never
+	stats time.Duration
+	// whether the lines of the files are printed in the order of their
+	// time, and how long live lines are held back for that
+	merge       bool
+	mergeWindow time.Duration
+	// highlight rules and presets
+	highlights []string
+	presets    []string
+	// minimum level of the lines shown, and how the level is detected,
+	// optionally scoped to a file
+	levels         []string
+	levelDetectors []string
+	// when to color the lines by their level, auto, always or never
+	levelColors string
+}
+
+// parseArgs walks through the given arguments (without the bin name)
+// and collects the flags and the files to tail. Help and version flags
+// are served right away.
+func parseArgs(args []string) *options {
+	opts := &options{
+		files:     make([]string, 0),
+		encodings: make([]string, 0),
+		sanitize:  "auto",
+		output:    OUTPUT_TEXT,
+		before:    -1,
+		after:     -1,
+		ansi:      ANSI_ESCAPE,
+
+		levelColors: "auto",
+		mergeWindow: DEFAULT_MERGE_WINDOW,
+
+		execConcurrency: DEFAULT_EXEC_CONCURRENCY,
+		execTimeout:     DEFAULT_EXEC_TIMEOUT,
+
+		alertContext:   DEFAULT_ALERT_CONTEXT,
+		webhookBatch:   DEFAULT_WEBHOOK_BATCH,
+		webhookRetries: DEFAULT_WEBHOOK_RETRIES,
+
+		forwardBuffer: DEFAULT_FORWARD_BUFFER,
+		serveBacklog:  DEFAULT_SERVE_BACKLOG,
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if !strings.HasPrefix(arg, "-") {
+			// should be either a single file name, multiple filenames or a file pattern
+			fname, err := parseFileName(arg)
+			if err != nil {
+				printErr(fmt.Sprintf("file not found: %s", arg))
+				showUsage()
+				os.Exit(0)
+			}
+
+			opts.files = append(opts.files, fname)
+			continue
+		}
+
+		name := flagName(arg)
+		switch name {
+		case "-h", "--help":
+			showUsage()
+			os.Exit(0)
+		case "-v", "--version":
+			showVersion()
+			os.Exit(0)
+		case "--encoding":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid encoding flag")
+
+			opts.encodings = append(opts.encodings, v)
+		case "--crlf":
+			opts.crlf = true
+		case "--match", "--grep":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid match flag")
+
+			opts.match = append(opts.match, v)
+		case "--imatch":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid match flag")
+
+			opts.imatch = append(opts.imatch, v)
+		case "--exclude", "--grep-v":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exclude flag")
+
+			opts.exclude = append(opts.exclude, v)
+		case "--iexclude":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exclude flag")
+
+			opts.iexclude = append(opts.iexclude, v)
+		case "--where":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid where flag")
+
+			opts.where = append(opts.where, v)
+		case "--app":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid app flag")
+
+			opts.apps = append(opts.apps, v)
+		case "-A", "--after-context":
+			opts.after = contextValue(args, &i)
+		case "-B", "--before-context":
+			opts.before = contextValue(args, &i)
+		case "-C", "--context":
+			c := contextValue(args, &i)
+			if opts.after < 0 {
+				opts.after = c
+			}
+			if opts.before < 0 {
+				opts.before = c
+			}
+		case "--output", "-o":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid output flag")
+
+			if v != OUTPUT_TEXT && v != OUTPUT_JSON {
+				handleErrorAndExit(fmt.Errorf("unknown output format %s", v), "invalid output flag")
+			}
+
+			opts.output = v
+		case "--timestamps":
+			// the format is optional, and only given as --timestamps=format
+			opts.timestamps = true
+			opts.timestampFormat = strings.TrimPrefix(arg, "--timestamps")
+			opts.timestampFormat = strings.TrimPrefix(opts.timestampFormat, "=")
+		case "--template":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid template flag")
+
+			opts.template = v
+		case "--format":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid format flag")
+
+			opts.formats = append(opts.formats, v)
+		case "--json":
+			opts.formats = append(opts.formats, "json")
+			if opts.render == "" {
+				opts.render = "pretty"
+			}
+		case "--logfmt":
+			opts.formats = append(opts.formats, "logfmt")
+			if opts.render == "" {
+				opts.render = "logfmt"
+			}
+		case "--grok-patterns":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid grok patterns flag")
+
+			opts.grokFiles = append(opts.grokFiles, v)
+		case "--syslog":
+			opts.formats = append(opts.formats, "syslog")
+		case "--pretty":
+			opts.render = "pretty"
+		case "--render":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid render flag")
+
+			opts.render = v
+		case "--fields":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid fields flag")
+
+			opts.fields = v
+		case "--header":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid header flag")
+
+			opts.header = v
+		case "--time-keys":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid time keys flag")
+
+			opts.timeKeys = v
+		case "--level-keys":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid level keys flag")
+
+			opts.levelKeys = v
+		case "--level":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid level flag")
+
+			opts.levels = append(opts.levels, v)
+		case "--level-detector":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid level detector flag")
+
+			opts.levelDetectors = append(opts.levelDetectors, v)
+		case "--level-colors":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid level colors flag")
+
+			opts.levelColors = v
+		case "--msg-keys":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid message keys flag")
+
+			opts.msgKeys = v
+		case "--highlight":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid highlight flag")
+
+			opts.highlights = append(opts.highlights, v)
+		case "--highlight-preset":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid highlight preset flag")
+
+			opts.presets = append(opts.presets, v)
+		case "--exec-on-match":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exec on match flag")
+
+			opts.execs = append(opts.execs, v)
+		case "--exec-concurrency":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exec concurrency flag")
+
+			opts.execConcurrency, err = strconv.Atoi(v)
+			if err == nil && opts.execConcurrency < 1 {
+				err = fmt.Errorf("has to be at least 1, got %d", opts.execConcurrency)
+			}
+			handleErrorAndExit(err, "invalid exec concurrency flag")
+		case "--exec-timeout":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exec timeout flag")
+
+			opts.execTimeout, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid exec timeout flag")
+		case "--exec-debounce":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exec debounce flag")
+
+			opts.execDebounce, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid exec debounce flag")
+		case "--exec-log":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid exec log flag")
+
+			opts.execLog = v
+		case "--alert":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid alert flag")
+
+			opts.alerts = append(opts.alerts, v)
+		case "--alert-context":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid alert context flag")
+
+			opts.alertContext, err = strconv.Atoi(v)
+			if err == nil && opts.alertContext < 0 {
+				err = fmt.Errorf("can't be negative, got %d", opts.alertContext)
+			}
+			handleErrorAndExit(err, "invalid alert context flag")
+		case "--webhook":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid webhook flag")
+
+			opts.webhook = v
+		case "--webhook-header":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid webhook header flag")
+
+			opts.webhookHeaders = append(opts.webhookHeaders, v)
+		case "--webhook-template":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid webhook template flag")
+
+			opts.webhookTemplate = v
+		case "--webhook-batch":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid webhook batch flag")
+
+			opts.webhookBatch, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid webhook batch flag")
+		case "--webhook-retries":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid webhook retries flag")
+
+			opts.webhookRetries, err = strconv.Atoi(v)
+			if err == nil && opts.webhookRetries < 0 {
+				err = fmt.Errorf("can't be negative, got %d", opts.webhookRetries)
+			}
+			handleErrorAndExit(err, "invalid webhook retries flag")
+		case "--forward":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid forward flag")
+
+			opts.forward = v
+		case "--forward-app":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid forward app flag")
+
+			opts.forwardApps = append(opts.forwardApps, v)
+		case "--forward-ca":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid forward ca flag")
+
+			opts.forwardCA = v
+		case "--forward-buffer":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid forward buffer flag")
+
+			opts.forwardBuffer, err = strconv.Atoi(v)
+			if err == nil && opts.forwardBuffer < 1 {
+				err = fmt.Errorf("has to be at least 1, got %d", opts.forwardBuffer)
+			}
+			handleErrorAndExit(err, "invalid forward buffer flag")
+		case "--forward-spool":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid forward spool flag")
+
+			opts.forwardSpool = v
+		case "--serve":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid serve flag")
+
+			opts.serve = v
+		case "--serve-backlog":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid serve backlog flag")
+
+			opts.serveBacklog, err = strconv.Atoi(v)
+			if err == nil && opts.serveBacklog < 0 {
+				err = fmt.Errorf("can't be negative, got %d", opts.serveBacklog)
+			}
+			handleErrorAndExit(err, "invalid serve backlog flag")
+		case "--tee":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid tee flag")
+
+			opts.tee = v
+		case "--tee-max-size":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid tee max size flag")
+
+			opts.teeMaxSize, err = sizeValue(v)
+			handleErrorAndExit(err, "invalid tee max size flag")
+		case "--tee-rotate":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid tee rotate flag")
+
+			opts.teeRotate, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid tee rotate flag")
+		case "--tee-compress":
+			opts.teeCompress = true
+		case "--tee-keep":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid tee keep flag")
+
+			opts.teeKeep, err = strconv.Atoi(v)
+			if err == nil && opts.teeKeep < 0 {
+				err = fmt.Errorf("can't be negative, got %d", opts.teeKeep)
+			}
+			handleErrorAndExit(err, "invalid tee keep flag")
+		case "--metrics":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid metrics flag")
+
+			opts.metrics = v
+		case "--metric":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid metric flag")
+
+			opts.metricRules = append(opts.metricRules, v)
+		case "--sink":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid sink flag")
+
+			opts.sinks = append(opts.sinks, v)
+		case "--until":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid until flag")
+
+			opts.until = append(opts.until, v)
+		case "--fail-on":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid fail on flag")
+
+			opts.failOn = append(opts.failOn, v)
+		case "--timeout":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid timeout flag")
+
+			opts.timeout, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid timeout flag")
+		case "--merge":
+			opts.merge = true
+		case "--merge-window":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid merge window flag")
+
+			opts.mergeWindow, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid merge window flag")
+		case "--stats":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid stats flag")
+
+			opts.stats, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid stats flag")
+		case "--summary":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid summary flag")
+
+			opts.summary, err = intervalValue(v)
+			handleErrorAndExit(err, "invalid summary flag")
+		case "--sanitize":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid sanitize flag")
+
+			opts.sanitize = v
+		case "--ansi":
+			v, err := flagValue(args, &i)
+			handleErrorAndExit(err, "invalid ansi flag")
+
+			opts.ansi = v
+		default:
+			// is it the line count flag
+			lc, err := readLineCountArg(arg)
+			handleErrorAndExit(err, fmt.Sprintf("unknown flag: %s", arg))
+
+			// it is the line count flag
+			opts.lineCount = lc
+		}
+	}
+
+	// grok expressions might use the patterns of the files
+	for _, f := range opts.grokFiles {
+		err := loadGrokPatterns(f)
+		handleErrorAndExit(err, "invalid grok patterns file")
+	}
+
+	// check early if the given encodings and formats are usable
+	for _, f := range opts.files {
+		_, err := newEncoding(opts.valueFor(opts.encodings, f, "auto"))
+		handleErrorAndExit(err, fmt.Sprintf("invalid encoding for %s", filepath.Base(f)))
+
+		if format := opts.valueFor(opts.formats, f, ""); format != "" {
+			_, err = newParser(format)
+			handleErrorAndExit(err, fmt.Sprintf("invalid format for %s", filepath.Base(f)))
+		}
+
+		if level := opts.valueFor(opts.levels, f, ""); level != "" {
+			if _, ok := parseLevel(level); !ok {
+				handleErrorAndExit(fmt.Errorf("unknown level %s", level), fmt.Sprintf("invalid level for %s", filepath.Base(f)))
+			}
+		}
+
+		_, err = newLevelDetector(opts.valueFor(opts.levelDetectors, f, "auto"), nil)
+		handleErrorAndExit(err, fmt.Sprintf("invalid level detector for %s", filepath.Base(f)))
+	}
+
+	switch opts.levelColors {
+	case "auto", "always", "never":
+	default:
+		handleErrorAndExit(fmt.Errorf("unknown mode %s", opts.levelColors), "invalid level colors flag")
+	}
+
+	return opts
+}
+
+// intervalValue reads an interval given in seconds or as a duration,
+// ie: 10 or 1m30s
+func intervalValue(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if n, nerr := strconv.Atoi(v); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("interval has to be positive, got %s", v)
+	}
+
+	return d, nil
+}
+
+// sizeValue reads a size in bytes, optionally with a K, M or G suffix,
+// ie: 512K or 10M
+func sizeValue(v string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+
+	s := strings.TrimSuffix(strings.ToUpper(v), "B")
+	unit := int64(1)
+	if len(s) > 0 {
+		if u, ok := units[s[len(s)-1:]]; ok {
+			s, unit = s[:len(s)-1], u
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s", v)
+	}
+
+	if n <= 0 {
+		return 0, fmt.Errorf("size has to be positive, got %s", v)
+	}
+
+	return n * unit, nil
+}
+
+// contextValue reads the line count of a context flag
+func contextValue(args []string, i *int) int {
+	v, err := flagValue(args, i)
+	handleErrorAndExit(err, "invalid context flag")
+
+	c, err := strconv.Atoi(v)
+	if err == nil && c < 0 {
+		err = fmt.Errorf("negative line count %d", c)
+	}
+	handleErrorAndExit(err, "invalid context line count")
+
+	return c
+}
+
+// flagName returns the name part of a flag, stripping any value given
+// in the --flag=value form
+func flagName(arg string) string {
+	if i := strings.Index(arg, "="); i > 0 {
+		return arg[:i]
+	}
+
+	return arg
+}
+
+// flagValue returns the value of the flag at position i, either given
+// as --flag=value or as --flag value. In the latter form, i is moved
+// past the consumed value.
+func flagValue(args []string, i *int) (string, error) {
+	arg := args[*i]
+	if j := strings.Index(arg, "="); j > 0 {
+		return arg[j+1:], nil
+	}
+
+	if *i+1 >= len(args) {
+		return "", fmt.Errorf("%s needs a value", arg)
+	}
+
+	*i++
+	return args[*i], nil
+}
+
+// valuesFor returns the values of a file scoped flag that apply to the
+// given file. A value can be limited to a single file by prefixing it
+// with the file name, ie: app.log:utf-16le. Values without a file
+// prefix apply to all files.
+func (o *options) valuesFor(vals []string, fname string) []string {
+	res := make([]string, 0)
+	for _, v := range vals {
+		scope, rest, ok := o.splitScope(v)
+		if !ok {
+			res = append(res, v)
+			continue
+		}
+
+		if scope == fname {
+			res = append(res, rest)
+		}
+	}
+
+	return res
+}
+
+// valueFor returns the last value of a file scoped flag that applies to
+// the given file, or the default if none do
+func (o *options) valueFor(vals []string, fname string, def string) string {
+	res := o.valuesFor(vals, fname)
+	if len(res) == 0 {
+		return def
+	}
+
+	return res[len(res)-1]
+}
+
+// splitScope checks if the given value is prefixed by one of the tailed
+// files, either by its base name or its path.
+// Returns the absolute file name, the rest of the value and whether a
+// file prefix was found
+func (o *options) splitScope(v string) (string, string, bool) {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+
+	prefix := v[:i]
+	abs, err := filepath.Abs(prefix)
+	if err != nil {
+		abs = prefix
+	}
+
+	for _, f := range o.files {
+		if prefix == filepath.Base(f) || abs == f {
+			return f, v[i+1:], true
+		}
+	}
+
+	return "", "", false
+}
+
+// splitList splits a comma separated flag value, returning the default
+// if the value is empty
+func splitList(v string, def []string) []string {
+	if v == "" {
+		return def
+	}
+
+	res := make([]string, 0)
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Field is a single named value parsed from a structured line
+type Field struct {
+	Key   string
+	Value string
+	// set if the value isn't a plain string, ie: a json number, bool,
+	// null, object or array
+	Literal bool
+}
+
+// Record holds the fields parsed from a structured line, in the order
+// they appeared in
+type Record struct {
+	// the name of the format the line was parsed as
+	Format string
+	Fields []Field
+}
+
+// get returns the value of the first field with the given key
+func (r *Record) get(key string) (string, bool) {
+	for _, f := range r.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// first returns the first of the given keys present in the record, and
+// its value
+func (r *Record) first(keys []string) (string, string, bool) {
+	for _, k := range keys {
+		if v, ok := r.get(k); ok {
+			return k, v, true
+		}
+	}
+
+	return "", "", false
+}
+
+// Parser extracts fields out of the lines of a structured log
+type Parser interface {
+	// parse returns the fields of the given line, or false if the line
+	// isn't in the format of the parser
+	parse(line string) (*Record, bool)
+}
+
+// newParser creates the Parser for the named log format
+func newParser(format string) (Parser, error) {
+	switch format {
+	case "json":
+		return &jsonParser{}, nil
+	case "logfmt":
+		return &logfmtParser{}, nil
+	case "syslog":
+		return &syslogParser{}, nil
+	case "common":
+		return newAccessParser(COMMON_LOG_FORMAT)
+	case "combined":
+		return newAccessParser(COMBINED_LOG_FORMAT)
+	}
+
+	// a custom access log format, ie: nginx:$remote_addr [$time_local] ...
+	if strings.HasPrefix(format, "nginx:") {
+		return newAccessParser(strings.TrimPrefix(format, "nginx:"))
+	}
+
+	// a grok expression, ie: grok:%{LOGLEVEL:level} %{GREEDYDATA:msg}
+	if strings.HasPrefix(format, "grok:") {
+		return newGrokParser(strings.TrimPrefix(format, "grok:"))
+	}
+
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// jsonParser parses lines holding a single json object
+type jsonParser struct{}
+
+func (p *jsonParser) parse(line string) (*Record, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return nil, false
+	}
+
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+
+	// a map would lose the order of the keys, walk the tokens instead
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, false
+	}
+
+	r := &Record{Format: "json"}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+
+		key, ok := t.(string)
+		if !ok {
+			return nil, false
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, false
+		}
+
+		r.Fields = append(r.Fields, jsonField(key, raw))
+	}
+
+	// the closing brace, and nothing after it
+	if t, err := dec.Token(); err != nil || t != json.Delim('}') {
+		return nil, false
+	}
+
+	if dec.More() {
+		return nil, false
+	}
+
+	return r, true
+}
+
+// jsonField converts a raw json value to a Field. Strings are unquoted,
+// anything else is kept in its compact json form
+func jsonField(key string, raw json.RawMessage) Field {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return Field{Key: key, Value: s}
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return Field{Key: key, Value: string(raw), Literal: true}
+	}
+
+	return Field{Key: key, Value: buf.String(), Literal: true}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	// default keys the time, level and message of a structured line
+	// can be found under
+	DEFAULT_TIME_KEYS  = []string{"time", "ts", "timestamp", "@timestamp", "t"}
+	DEFAULT_LEVEL_KEYS = []string{"level", "severity", "lvl", "loglevel"}
+	DEFAULT_MSG_KEYS   = []string{"msg", "message", "text"}
+
+	keyStyle = mustStyle("dim")
+)
+
+// PrettyRenderer prints the fields of structured lines as a header
+// (time, colored level and message by default) followed by the rest of
+// the fields as key=value pairs
+type PrettyRenderer struct {
+	// what the header is made of, time, level, msg, or any field key
+	header    []string
+	timeKeys  []string
+	levelKeys []string
+	msgKeys   []string
+	// the key=value pairs start at this column after the header, so
+	// that they line up
+	width int
+}
+
+func newPrettyRenderer(header []string) *PrettyRenderer {
+	return &PrettyRenderer{
+		header:    header,
+		timeKeys:  DEFAULT_TIME_KEYS,
+		levelKeys: DEFAULT_LEVEL_KEYS,
+		msgKeys:   DEFAULT_MSG_KEYS,
+		width:     60,
+	}
+}
+
+// render prints the given record. clean is applied to every value
+// before it's styled, and mark to the message.
+func (p *PrettyRenderer) render(r *Record, clean func(string) string, mark func(string) string) string {
+	used := make(map[string]bool)
+	parts := make([]string, 0, len(p.header))
+
+	for _, h := range p.header {
+		var keys []string
+		switch h {
+		case "time":
+			keys = p.timeKeys
+		case "level":
+			keys = p.levelKeys
+		case "msg":
+			keys = p.msgKeys
+		default:
+			keys = []string{h}
+		}
+
+		k, v, ok := r.first(keys)
+		if !ok {
+			continue
+		}
+		used[k] = true
+
+		v = clean(v)
+		switch h {
+		case "level":
+			parts = append(parts, levelStyle(v).apply(padRight(strings.ToUpper(v), 5)))
+		case "msg":
+			parts = append(parts, mark(v))
+		default:
+			parts = append(parts, v)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.Join(parts, " "))
+
+	first := true
+	for _, f := range r.Fields {
+		if used[f.Key] {
+			continue
+		}
+
+		if first {
+			// line up the pairs after the header
+			if n := visibleLen(b.String()); n < p.width {
+				b.WriteString(strings.Repeat(" ", p.width-n))
+			}
+			first = false
+		}
+
+		b.WriteString(" ")
+		b.WriteString(keyStyle.apply(clean(f.Key) + "="))
+		v := quoteValue(clean(f.Value), f.Literal)
+		if f.Key == "status" && r.Format == "access" {
+			v = levelStyles[statusLevel(f.Value)].apply(v)
+		}
+		b.WriteString(v)
+	}
+
+	return b.String()
+}
+
+// quoteValue quotes a value if it contains spaces, quotes, equal signs
+// or control characters, so that it can be read back as a key=value pair
+func quoteValue(v string, literal bool) string {
+	if literal {
+		return v
+	}
+
+	if v == "" || strings.ContainsAny(v, " \t\"=\\") {
+		return strconv.Quote(v)
+	}
+
+	for _, r := range v {
+		if r < 0x20 || r == 0x7f {
+			return strconv.Quote(v)
+		}
+	}
+
+	return v
+}
+
+// padRight pads the string with spaces up to the given width
+func padRight(s string, w int) string {
+	if n := visibleLen(s); n < w {
+		return s + strings.Repeat(" ", w-n)
+	}
+
+	return s
+}
@@ -1,35 +1,98 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+	"text/template"
+	"time"
+)
+
+// events that can happen to a tailed file
+const (
+	EVENT_TRUNCATED = "truncated"
+	EVENT_ROTATED   = "rotated"
+	EVENT_DELETED   = "deleted"
+	// not an event of a file, a periodic summary of access logs
+	EVENT_SUMMARY = "summary"
 )
 
 type PrintContent struct {
 	filename string
-	content  string
+	lines    []*Line
 	color    func(string) string
+	// inode of the file the lines were read from
+	inode uint64
+	// when the lines were read
+	readAt time.Time
+	// set if this informs of an event instead of carrying lines
+	event string
+	// the summary of a summary event
+	summary *AccessSummary
+	// set if tailing ends after these lines, with the exit code
+	stop     bool
+	exitCode int
+}
+
+// Line is a single line to be printed
+type Line struct {
+	text string
+	// file offset the line starts at
+	offset int64
+	// line number in the file, 0 if not tracked
+	lineNo int64
+	// fields parsed from the line, nil if it isn't structured
+	record *Record
+	// severity of the line, 0 if unknown
+	level int
+	// set for lines shown as context around a match
+	context bool
+	// set for the separator between non-contiguous groups of lines
+	separator bool
 }
 
+// output formats
+const (
+	OUTPUT_TEXT = "text"
+	OUTPUT_JSON = "json"
+)
+
 type ContentPrinter struct {
-	multiFile bool
-}
-
-// start initiates a loop that will constantly watch for print events
-// and output them using the information provided
-func (p *ContentPrinter) start(contents <-chan *PrintContent, done <-chan bool) {
-	for {
-		select {
-		case c := <-contents:
-			debug(fmt.Sprintf("printer: received print content for file %s", c.filename))
-			p.print(c)
-		case <-done:
-			debug("printer: received notice to shutdown")
-			return
-		}
-	}
+	// how each line is printed in the text output
+	template *template.Template
+	// one of the output formats
+	output string
+	// escapes control characters in the content, nil if the content
+	// should be printed as is
+	sanitizer *Sanitizer
+	// prefixes the lines with the time they were read, nil if not
+	timestamps *Timestamper
+	// styles the parts of the lines matching the rules
+	highlights []*HighlightRule
+	// prints the fields of structured lines, nil to print them as is
+	renderer RecordRenderer
+	// fields to render, in order. nil renders all fields
+	fields []string
+	// whether lines are colored by their level
+	levelColors bool
+	// where the lines are printed, stdout
+	out *bufio.Writer
+	// whether colors and styles are left out, for files
+	plain bool
+}
+
+// write prints the content, it's the sink of the terminal
+func (p *ContentPrinter) write(c *PrintContent) error {
+	p.print(c)
+	return nil
+}
+
+// flush writes out what's printed so far
+func (p *ContentPrinter) flush() error {
+	return p.out.Flush()
+}
+
+func (p *ContentPrinter) close() error {
+	return p.flush()
 }
 
 // print prints the given PrintContent object to stdout
@@ -37,13 +100,83 @@ func (p *ContentPrinter) start(contents <-chan *PrintContent, done <-chan bool)
 // is determined by the PrintContent config
 func (p *ContentPrinter) print(c *PrintContent) {
 	debug(fmt.Sprintf("printer: printing line for %s", c.filename))
-	if p.multiFile {
-		lines := strings.Split(strings.Trim(c.content, "\n"), "\n")
-		for _, l := range lines {
-			bfn := filepath.Base(c.filename)
-			_, _ = fmt.Fprint(os.Stdout, fmt.Sprintf("%s %s\n", c.color(bfn+" => "), l))
+	if p.output == OUTPUT_JSON {
+		p.printJSON(c)
+		return
+	}
+
+	if c.event == EVENT_SUMMARY {
+		out := boldBlue.apply(c.summary.String())
+		if p.timestamps != nil {
+			out = p.timestamps.stamp(c.readAt) + " " + out
+		}
+
+		p.println(out)
+		return
+	}
+
+	// events of files are only shown in the json output
+	if c.event != "" {
+		return
+	}
+
+	for _, line := range c.lines {
+		l := line.text
+		if line.separator {
+			l = "--"
+		} else if line.record != nil && p.renderer != nil {
+			r := line.record
+			if p.fields != nil {
+				r = project(r, p.fields)
+			}
+
+			l = p.renderer.render(r, p.clean, p.mark)
+		} else {
+			l = highlight(p.clean(l), p.levelStyle(line), p.highlights)
+		}
+
+		out, err := render(p.template, c, line, l)
+		if err != nil {
+			printErr(err.Error())
+			continue
+		}
+
+		if p.timestamps != nil && !line.separator {
+			out = p.timestamps.stamp(c.readAt) + " " + out
 		}
-	} else {
-		_, _ = fmt.Fprint(os.Stdout, c.content)
+
+		p.println(out)
 	}
 }
+
+// println prints a line of the output
+func (p *ContentPrinter) println(s string) {
+	if p.plain {
+		s = stripANSI(s)
+	}
+
+	_, _ = fmt.Fprintln(p.out, s)
+}
+
+// clean makes the given string safe to print, if sanitizing is enabled
+func (p *ContentPrinter) clean(s string) string {
+	if p.sanitizer == nil {
+		return s
+	}
+
+	return p.sanitizer.sanitize(s)
+}
+
+// mark applies the highlight rules to the given string
+func (p *ContentPrinter) mark(s string) string {
+	return highlight(s, Style{}, p.highlights)
+}
+
+// levelStyle returns the style the line is colored with, by its level
+func (p *ContentPrinter) levelStyle(l *Line) Style {
+	if !p.levelColors || l.context {
+		return Style{}
+	}
+
+	return levelStyles[l.level]
+}
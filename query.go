@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Query filters structured lines by their fields, ie:
+//
+//	level>=warn && user_id==42 && (duration>1.5s || path=~"^/api")
+//
+// Comparisons are ==, !=, <, <=, >, >=, contains, =~ and !~ (regex
+// match). Values are compared as log levels, numbers or durations if
+// both sides can be read as such, and as strings otherwise. A bare
+// field name checks that the field is present and not empty, false or
+// 0. Comparisons can be combined with &&, ||, ! and parentheses.
+type Query struct {
+	root queryNode
+	// keys holding the level of a line, compared by severity
+	levelKeys []string
+}
+
+// queryNode is a node of the parsed expression tree
+type queryNode interface {
+	eval(q *Query, r *Record) bool
+}
+
+// QueryError is a parse error, pointing at where in the expression it
+// happened
+type QueryError struct {
+	expr string
+	pos  int
+	msg  string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d\n  %s\n  %s^", e.msg, e.pos+1, e.expr, strings.Repeat(" ", e.pos))
+}
+
+// newQuery parses the given expression
+func newQuery(expr string, levelKeys []string) (*Query, error) {
+	p := &queryParser{expr: expr}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorAt(t, fmt.Sprintf("unexpected %s", t.text))
+	}
+
+	return &Query{root: root, levelKeys: levelKeys}, nil
+}
+
+// matches evaluates the query against the fields of a line. Lines
+// without fields never match.
+func (q *Query) matches(r *Record) bool {
+	if r == nil {
+		return false
+	}
+
+	return q.root.eval(q, r)
+}
+
+// token kinds
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type queryToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// queryParser is a recursive descent parser for query expressions
+type queryParser struct {
+	expr   string
+	tokens []queryToken
+	next   int
+}
+
+func (p *queryParser) errorAt(t queryToken, msg string) error {
+	return &QueryError{expr: p.expr, pos: t.pos, msg: msg}
+}
+
+// lex splits the expression into tokens
+func (p *queryParser) lex() error {
+	s := p.expr
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			p.tokens = append(p.tokens, queryToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, queryToken{tokRParen, ")", i})
+			i++
+		case strings.HasPrefix(s[i:], "&&"):
+			p.tokens = append(p.tokens, queryToken{tokAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			p.tokens = append(p.tokens, queryToken{tokOr, "||", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "=="), strings.HasPrefix(s[i:], "!="),
+			strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="),
+			strings.HasPrefix(s[i:], "=~"), strings.HasPrefix(s[i:], "!~"):
+			p.tokens = append(p.tokens, queryToken{tokOp, s[i : i+2], i})
+			i += 2
+		case c == '<' || c == '>':
+			p.tokens = append(p.tokens, queryToken{tokOp, s[i : i+1], i})
+			i++
+		case c == '!':
+			p.tokens = append(p.tokens, queryToken{tokNot, "!", i})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return &QueryError{expr: s, pos: i, msg: "unterminated string"}
+			}
+
+			p.tokens = append(p.tokens, queryToken{tokString, s[i+1 : i+1+end], i})
+			i += end + 2
+		case isQueryWordChar(c):
+			start := i
+			for i < len(s) && isQueryWordChar(s[i]) {
+				i++
+			}
+
+			word := s[start:i]
+			kind := tokIdent
+			switch {
+			case word == "contains":
+				kind = tokOp
+			case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+				kind = tokNumber
+			}
+
+			p.tokens = append(p.tokens, queryToken{kind, word, start})
+		default:
+			return &QueryError{expr: s, pos: i, msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+
+	p.tokens = append(p.tokens, queryToken{tokEOF, "end of expression", len(s)})
+	return nil
+}
+
+// isQueryWordChar checks if the character can be a part of a field name
+// or a bare value
+func isQueryWordChar(c byte) bool {
+	return c == '_' || c == '.' || c == '@' || c == '-' || c == '+' || c == '/' || c == ':' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.next]
+}
+
+func (p *queryParser) take() queryToken {
+	t := p.tokens[p.next]
+	if t.kind != tokEOF {
+		p.next++
+	}
+
+	return t
+}
+
+// parseOr parses a || b || ...
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOr {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+// parseAnd parses a && b && ...
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokAnd {
+		p.take()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+// parseUnary parses !a, (a) and comparisons
+func (p *queryParser) parseUnary() (queryNode, error) {
+	t := p.take()
+	switch t.kind {
+	case tokNot:
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{n}, nil
+	case tokLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if c := p.take(); c.kind != tokRParen {
+			return nil, p.errorAt(c, fmt.Sprintf("expected ) but found %s", c.text))
+		}
+
+		return n, nil
+	case tokIdent, tokString:
+		op := p.peek()
+		if op.kind != tokOp {
+			// a bare field name
+			return &presentNode{key: t.text}, nil
+		}
+		p.take()
+
+		v := p.take()
+		if v.kind != tokIdent && v.kind != tokString && v.kind != tokNumber {
+			return nil, p.errorAt(v, fmt.Sprintf("expected a value after %s but found %s", op.text, v.text))
+		}
+
+		return newCompareNode(t.text, op, v, p)
+	}
+
+	return nil, p.errorAt(t, fmt.Sprintf("expected a field name but found %s", t.text))
+}
+
+type orNode struct{ left, right queryNode }
+
+func (n *orNode) eval(q *Query, r *Record) bool {
+	return n.left.eval(q, r) || n.right.eval(q, r)
+}
+
+type andNode struct{ left, right queryNode }
+
+func (n *andNode) eval(q *Query, r *Record) bool {
+	return n.left.eval(q, r) && n.right.eval(q, r)
+}
+
+type notNode struct{ n queryNode }
+
+func (n *notNode) eval(q *Query, r *Record) bool {
+	return !n.n.eval(q, r)
+}
+
+// presentNode checks that a field is there and isn't empty or false
+type presentNode struct{ key string }
+
+func (n *presentNode) eval(q *Query, r *Record) bool {
+	v, ok := r.get(n.key)
+	if !ok {
+		return false
+	}
+
+	switch v {
+	case "", "false", "0", "null":
+		return false
+	}
+
+	return true
+}
+
+// compareNode compares a field with a value
+type compareNode struct {
+	key   string
+	op    string
+	value string
+	re    *regexp.Regexp
+	// the value read as a number, a duration and a log level, if it
+	// can be read as such
+	num     float64
+	isNum   bool
+	dur     time.Duration
+	isDur   bool
+	level   int
+	isLevel bool
+}
+
+func newCompareNode(key string, op queryToken, v queryToken, p *queryParser) (*compareNode, error) {
+	n := &compareNode{key: key, op: op.text, value: v.text}
+
+	if n.op == "=~" || n.op == "!~" {
+		re, err := regexp.Compile(v.text)
+		if err != nil {
+			return nil, p.errorAt(v, fmt.Sprintf("invalid regex: %s", err))
+		}
+
+		n.re = re
+		return n, nil
+	}
+
+	if f, err := strconv.ParseFloat(v.text, 64); err == nil {
+		n.num, n.isNum = f, true
+	}
+
+	if d, err := time.ParseDuration(v.text); err == nil && !n.isNum {
+		n.dur, n.isDur = d, true
+	}
+
+	n.level, n.isLevel = parseLevel(v.text)
+
+	return n, nil
+}
+
+func (n *compareNode) eval(q *Query, r *Record) bool {
+	v, ok := r.get(n.key)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "=~":
+		return n.re.MatchString(v)
+	case "!~":
+		return !n.re.MatchString(v)
+	case "contains":
+		return strings.Contains(v, n.value)
+	}
+
+	// log levels are compared by severity
+	if n.isLevel && isLevelKey(n.key, q.levelKeys) {
+		if l, ok := parseLevel(v); ok {
+			return compareInts(l, n.level, n.op)
+		}
+	}
+
+	if n.isNum {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return compareFloats(f, n.num, n.op)
+		}
+	}
+
+	if n.isDur {
+		if d, err := time.ParseDuration(v); err == nil {
+			return compareFloats(float64(d), float64(n.dur), n.op)
+		}
+	}
+
+	return compareStrings(v, n.value, n.op)
+}
+
+func compareInts(a, b int, op string) bool {
+	return compareFloats(float64(a), float64(b), op)
+}
+
+func compareFloats(a, b float64, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+
+	return false
+}
+
+func compareStrings(a, b string, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -61,6 +62,12 @@ func (e *EventReader) start(events chan<- syscall.InotifyEvent) {
 
 			debug(fmt.Sprintf("read inotify event for wd %d", event.Wd))
 
+			// events were lost, the files are read as usual on the next
+			// ones
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				atomic.AddInt64(&inotifyOverflows, 1)
+			}
+
 			// notify the waiting consumer of the event
 			// TODO buffer and gather all modify events to one to avoid spamming the consumer thread
 			events <- event
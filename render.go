@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RecordRenderer prints the fields of a structured line
+type RecordRenderer interface {
+	// render returns the printable form of the record. clean is to be
+	// applied to the values to make them safe to print, and mark to the
+	// free text parts to highlight them.
+	render(r *Record, clean func(string) string, mark func(string) string) string
+}
+
+// newRenderer creates the named RecordRenderer, one of pretty, logfmt or
+// json
+func newRenderer(name string, levelKeys []string) (RecordRenderer, error) {
+	switch name {
+	case "pretty":
+		return newPrettyRenderer([]string{"time", "level", "msg"}), nil
+	case "logfmt":
+		return &LogfmtRenderer{levelKeys: levelKeys}, nil
+	case "json":
+		return &JSONRenderer{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown renderer %s", name)
+}
+
+// JSONRenderer prints records as compact json objects, keeping the order
+// of the fields. No colors are used, so that the output can be fed to
+// other tools.
+type JSONRenderer struct{}
+
+func (j *JSONRenderer) render(r *Record, clean func(string) string, mark func(string) string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, f := range r.Fields {
+		if i > 0 {
+			b.WriteString(",")
+		}
+
+		k, _ := json.Marshal(f.Key)
+		b.Write(k)
+		b.WriteString(":")
+
+		if f.Literal {
+			b.WriteString(f.Value)
+			continue
+		}
+
+		v, _ := json.Marshal(f.Value)
+		b.Write(v)
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+// project picks the given fields out of the record, in the given order.
+// If the list ends with "...", the rest of the fields follow in their
+// original order.
+func project(r *Record, keys []string) *Record {
+	rest := false
+	if len(keys) > 0 && keys[len(keys)-1] == "..." {
+		rest = true
+		keys = keys[:len(keys)-1]
+	}
+
+	p := &Record{Format: r.Format, Fields: make([]Field, 0, len(r.Fields))}
+	picked := make(map[string]bool)
+	for _, k := range keys {
+		for _, f := range r.Fields {
+			if f.Key == k {
+				p.Fields = append(p.Fields, f)
+				picked[k] = true
+				break
+			}
+		}
+	}
+
+	if rest {
+		for _, f := range r.Fields {
+			if !picked[f.Key] {
+				p.Fields = append(p.Fields, f)
+			}
+		}
+	}
+
+	return p
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// what to do with ANSI escape sequences found in the content
+const (
+	// show them visibly, ie: \x1b[31m
+	ANSI_ESCAPE = "escape"
+	// remove them
+	ANSI_STRIP = "strip"
+	// let the terminal interpret them
+	ANSI_PASS = "pass"
+)
+
+// Sanitizer makes content safe to be written to a terminal. C0 and C1
+// control characters and invalid UTF-8 are replaced by a visible escaped
+// form, so that the content can't move the cursor, clear the screen or
+// fake the output of another file.
+type Sanitizer struct {
+	ansi string
+}
+
+// newSanitizer creates a Sanitizer for the given sanitize mode, one of
+// auto, always or never. auto only sanitizes if stdout is a terminal.
+// Returns nil if no sanitizing should be done
+func newSanitizer(mode string, ansi string) (*Sanitizer, error) {
+	switch ansi {
+	case ANSI_ESCAPE, ANSI_STRIP, ANSI_PASS:
+	default:
+		return nil, fmt.Errorf("unknown ansi mode %s", ansi)
+	}
+
+	switch mode {
+	case "auto":
+		if !isTerminal(os.Stdout) {
+			return nil, nil
+		}
+	case "always":
+	case "never":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown sanitize mode %s", mode)
+	}
+
+	return &Sanitizer{ansi: ansi}, nil
+}
+
+// sanitize returns the given content with control characters escaped.
+// New lines and tabs are left as they are.
+func (s *Sanitizer) sanitize(c string) string {
+	var b strings.Builder
+	b.Grow(len(c))
+
+	for i := 0; i < len(c); {
+		r, size := utf8.DecodeRuneInString(c[i:])
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// invalid UTF-8, show the raw byte
+			b.WriteString(fmt.Sprintf("\\x%02x", c[i]))
+		case r == '\x1b' && s.ansi != ANSI_ESCAPE:
+			l := ansiSequenceLen(c[i:])
+			if l == 0 {
+				// not a sequence we know of, escape it
+				b.WriteString("\\x1b")
+				break
+			}
+
+			if s.ansi == ANSI_PASS {
+				b.WriteString(c[i : i+l])
+			}
+			size = l
+		case r == '\n' || r == '\t':
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			b.WriteString(fmt.Sprintf("\\x%02x", r))
+		case r >= 0x80 && r <= 0x9f:
+			b.WriteString(fmt.Sprintf("\\u%04x", r))
+		default:
+			b.WriteString(c[i : i+size])
+		}
+
+		i += size
+	}
+
+	return b.String()
+}
+
+// ansiSequenceLen returns the length of the escape sequence at the start
+// of the given string, or 0 if it isn't a complete one. CSI (ESC [),
+// OSC (ESC ]) and two character sequences are recognized.
+func ansiSequenceLen(s string) int {
+	if len(s) < 2 || s[0] != '\x1b' {
+		return 0
+	}
+
+	switch s[1] {
+	case '[':
+		// parameter and intermediate bytes up to a final byte
+		for i := 2; i < len(s); i++ {
+			c := s[i]
+			if c >= 0x40 && c <= 0x7e {
+				return i + 1
+			}
+
+			if c < 0x20 || c > 0x3f {
+				return 0
+			}
+		}
+	case ']':
+		// terminated by BEL or ST (ESC \)
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+
+			if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+
+			if s[i] == '\n' {
+				return 0
+			}
+		}
+	default:
+		if s[1] >= 0x40 && s[1] <= 0x5f {
+			return 2
+		}
+	}
+
+	return 0
+}
+
+// stripANSI removes the escape sequences of the given string
+func stripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		if l := ansiSequenceLen(s[i:]); l > 0 {
+			i += l
+			continue
+		}
+
+		b.WriteByte(s[i])
+		i++
+	}
+
+	return b.String()
+}
+
+// isTerminal checks if the given file is a character device, ie: a
+// terminal rather than a pipe or a regular file
+func isTerminal(f *os.File) bool {
+	finfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return finfo.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+)
+
+// size of the blocks read while walking a file backwards
+const scanBlockSize = 4096
+
+// backwardScanner walks a file backwards from the end, one line at a
+// time. Lines are split on the new line of the given encoding.
+type backwardScanner struct {
+	f   *os.File
+	enc *Encoding
+	// file offset where buf starts
+	pos int64
+	// unconsumed content, from pos up to the end of the next line to
+	// be returned
+	buf []byte
+	// set when the start of the file has been handed out
+	finished bool
+	err      error
+}
+
+func newBackwardScanner(f *os.File, enc *Encoding) (*backwardScanner, error) {
+	finfo, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return &backwardScanner{
+		f:   f,
+		enc: enc,
+		pos: finfo.Size(),
+		buf: make([]byte, 0),
+	}, nil
+}
+
+// prev returns the line before the last returned one, without the
+// terminating new line, and the file offset it starts at. The first
+// call returns the last line of the file.
+// Returns false once the start of the file has been passed
+func (s *backwardScanner) prev() ([]byte, int64, bool) {
+	if s.finished || s.pos+int64(len(s.buf)) <= s.enc.bom {
+		return nil, 0, false
+	}
+
+	nl := len(s.enc.newline)
+
+	// strip the new line terminating this line
+	end := len(s.buf)
+	for {
+		if end >= nl || s.pos <= s.enc.bom {
+			break
+		}
+
+		if !s.fill() {
+			return nil, 0, false
+		}
+		end = len(s.buf)
+	}
+
+	if end >= nl && s.enc.isNewline(s.buf[end-nl:], s.pos+int64(end-nl)) {
+		end -= nl
+	}
+
+	// look for the new line terminating the previous line
+	i := end - nl
+	for {
+		for ; i >= 0; i-- {
+			if s.enc.isNewline(s.buf[i:], s.pos+int64(i)) {
+				line := s.buf[i+nl : end]
+				start := s.pos + int64(i+nl)
+				s.buf = s.buf[:i+nl]
+
+				return line, start, true
+			}
+		}
+
+		if s.pos <= s.enc.bom {
+			// reached the start of the content
+			s.finished = true
+			return s.buf[:end], s.pos, true
+		}
+
+		// need more content from before the current position
+		l := len(s.buf)
+		if !s.fill() {
+			return nil, 0, false
+		}
+
+		grown := len(s.buf) - l
+		end += grown
+		// continue from the last position not checked yet, a new line
+		// could be spanning the block boundary
+		i = grown - 1
+		if i > end-nl {
+			i = end - nl
+		}
+	}
+}
+
+// fill reads the block before the current position and prepends it to
+// the buffer
+func (s *backwardScanner) fill() bool {
+	start := s.pos - scanBlockSize
+	if start < s.enc.bom {
+		start = s.enc.bom
+	}
+
+	block := make([]byte, s.pos-start)
+	_, err := s.f.ReadAt(block, start)
+	if err != nil {
+		s.err = err
+		return false
+	}
+
+	s.buf = append(block, s.buf...)
+	s.pos = start
+
+	return true
+}
+
+// countLines counts the lines in the given file up to the given offset
+func countLines(f *os.File, enc *Encoding, end int64) (int64, error) {
+	var n int64
+	pending := make([]byte, 0)
+	pos := enc.bom
+
+	for pos < end {
+		size := int64(scanBlockSize)
+		if end-pos < size {
+			size = end - pos
+		}
+
+		block := make([]byte, size)
+		_, err := f.ReadAt(block, pos)
+		if err != nil {
+			return 0, err
+		}
+
+		data := append(pending, block...)
+		lines, used := enc.splitLines(data, pos-int64(len(pending)))
+		n += int64(len(lines))
+
+		pending = append(pending[:0], data[used:]...)
+		pos += size
+	}
+
+	return n, nil
+}
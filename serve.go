@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaults of the http server
+const (
+	// lines kept for the backlog of new clients
+	DEFAULT_SERVE_BACKLOG = 1000
+	// lines a new client starts with, unless it asks for more
+	DEFAULT_SERVE_LINES = 10
+	// contents waiting to be written to a client. Clients falling
+	// further behind are dropped.
+	SERVE_CLIENT_QUEUE = 256
+	// how long a write to a client can take before it's dropped
+	SERVE_WRITE_TIMEOUT = 10 * time.Second
+	// how often idle streams are pinged, to find the clients that left
+	SERVE_KEEPALIVE = 15 * time.Second
+)
+
+// the guid the accept key of the websocket handshake is made with
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket opcodes
+const (
+	WS_TEXT  = 0x1
+	WS_CLOSE = 0x8
+	WS_PING  = 0x9
+	WS_PONG  = 0xa
+)
+
+// colors of the files in the viewer, in the order of the terminal ones
+var serveColors = []string{"#e06c75", "#e5c07b", "#61afef", "#c678dd", "#98c379"}
+
+// Server streams the printed lines over http to browsers and remote
+// clients, each with their own filters
+type Server struct {
+	sync.Mutex
+	files     []string
+	levelKeys []string
+	listener  net.Listener
+	srv       *http.Server
+	// served on /metrics, nil if not
+	metrics *Metrics
+	clients map[*serveClient]bool
+	// the last lines, one per content, for new clients
+	backlog []*PrintContent
+	size    int
+}
+
+// newServer listens on the address, ie: :8080 or 0.0.0.0:8080. The lines
+// are only served on the loopback interface unless a host is given.
+func newServer(addr string, files []string, levelKeys []string, backlog int) (*Server, error) {
+	listener, err := listenLocal(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		files:     files,
+		levelKeys: levelKeys,
+		listener:  listener,
+		srv:       &http.Server{},
+		clients:   make(map[*serveClient]bool),
+		backlog:   make([]*PrintContent, 0, backlog),
+		size:      backlog,
+	}, nil
+}
+
+// listenLocal listens on the address, on the loopback interface if it
+// has no host, ie: :8080. Nothing is served without authentication to
+// other hosts unless asked for.
+func listenLocal(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// start serves the clients until the server's closed
+func (s *Server) start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleViewer)
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("/stream", s.handleText)
+	if s.metrics != nil {
+		mux.Handle("/metrics", s.metrics)
+	}
+	s.srv.Handler = mux
+
+	debug(fmt.Sprintf("server: listening on %s", s.listener.Addr()))
+	if err := s.srv.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		printErr(fmt.Sprintf("server: %s", err))
+	}
+}
+
+// close stops serving, and ends the streams of the clients
+func (s *Server) close() error {
+	debug("server: shutting down")
+	err := s.srv.Close()
+
+	s.Lock()
+	defer s.Unlock()
+	for c := range s.clients {
+		s.drop(c)
+	}
+
+	return err
+}
+
+// flush does nothing, the clients are written to as the lines come
+func (s *Server) flush() error {
+	return nil
+}
+
+// write keeps the lines of the content for the backlog and sends them
+// to the clients whose filters they match. Clients that can't keep up
+// are dropped.
+func (s *Server) write(c *PrintContent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// no backlog is kept with a size of 0
+	if c.event == "" && s.size > 0 {
+		for _, l := range c.lines {
+			if l.separator {
+				continue
+			}
+
+			if len(s.backlog) == s.size {
+				s.backlog = s.backlog[1:]
+			}
+			s.backlog = append(s.backlog, &PrintContent{
+				filename: c.filename,
+				color:    c.color,
+				inode:    c.inode,
+				readAt:   c.readAt,
+				lines:    []*Line{l},
+			})
+		}
+	}
+
+	for client := range s.clients {
+		filtered := client.accept(c)
+		if filtered == nil {
+			continue
+		}
+
+		select {
+		case client.queue <- filtered:
+		default:
+			debug(fmt.Sprintf("server: dropping %s, too slow", client.conn.RemoteAddr()))
+			s.drop(client)
+			// a write might be stuck on it
+			_ = client.conn.Close()
+		}
+	}
+
+	return nil
+}
+
+// register adds the client, and returns the last lines of the backlog
+// it accepts. Nothing's missed or sent twice in between.
+func (s *Server) register(client *serveClient, lines int) []*PrintContent {
+	s.Lock()
+	defer s.Unlock()
+
+	backlog := make([]*PrintContent, 0, lines)
+	for i := len(s.backlog) - 1; i >= 0 && len(backlog) < lines; i-- {
+		if c := client.accept(s.backlog[i]); c != nil {
+			backlog = append(backlog, c)
+		}
+	}
+
+	// oldest first
+	for i, j := 0, len(backlog)-1; i < j; i, j = i+1, j-1 {
+		backlog[i], backlog[j] = backlog[j], backlog[i]
+	}
+
+	s.clients[client] = true
+	return backlog
+}
+
+// remove drops the client, if it's still there
+func (s *Server) remove(client *serveClient) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.drop(client)
+}
+
+// drop stops sending to the client, which ends its stream
+func (s *Server) drop(client *serveClient) {
+	if !s.clients[client] {
+		return
+	}
+
+	delete(s.clients, client)
+	close(client.gone)
+}
+
+// serveClient is a connected client, and what it's sent
+type serveClient struct {
+	filter *LineFilter
+	// the files it's sent the lines of, all if empty
+	files []string
+	queue chan *PrintContent
+	// closed when the client is dropped
+	gone chan struct{}
+	conn net.Conn
+	// serializes the writes, websocket control frames come in between
+	writeMu sync.Mutex
+}
+
+// newServeClient reads the filters of the client from the query of the
+// request, ie: /events?match=error&level=warn&file=app.log&lines=100
+func (s *Server) newServeClient(r *http.Request) (*serveClient, int, error) {
+	q := r.URL.Query()
+
+	filter, err := newLineFilter(q["match"], q["imatch"], q["exclude"], q["iexclude"])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filter, err = filter.addQueries(q["where"], s.levelKeys)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if v := q.Get("level"); v != "" {
+		level, ok := parseLevel(v)
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown level %s", v)
+		}
+
+		filter = filter.setMinLevel(level)
+	}
+
+	lines := DEFAULT_SERVE_LINES
+	if v := q.Get("lines"); v != "" {
+		lines, err = strconv.Atoi(v)
+		if err != nil || lines < 0 {
+			return nil, 0, fmt.Errorf("invalid lines %s", v)
+		}
+	}
+
+	client := &serveClient{
+		filter: filter,
+		files:  q["file"],
+		queue:  make(chan *PrintContent, SERVE_CLIENT_QUEUE),
+		gone:   make(chan struct{}),
+	}
+
+	return client, lines, nil
+}
+
+// accept returns the content with the lines the client is sent, nil if
+// there's none. The lines shown as context are left to the filters of
+// the client.
+func (client *serveClient) accept(c *PrintContent) *PrintContent {
+	if !client.acceptsFile(c.filename) {
+		return nil
+	}
+
+	if client.filter == nil || c.event != "" {
+		return c
+	}
+
+	lines := make([]*Line, 0, len(c.lines))
+	for _, l := range c.lines {
+		if !l.separator && client.filter.matches(l) {
+			lines = append(lines, l)
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	filtered := *c
+	filtered.lines = lines
+	return &filtered
+}
+
+// acceptsFile checks if the client is sent the lines of the file, given
+// by its path or name
+func (client *serveClient) acceptsFile(fname string) bool {
+	if len(client.files) == 0 {
+		return true
+	}
+
+	for _, f := range client.files {
+		if f == fname || f == filepath.Base(fname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write writes to the client, which is dropped if it takes too long
+func (client *serveClient) write(b []byte) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	_ = client.conn.SetWriteDeadline(time.Now().Add(SERVE_WRITE_TIMEOUT))
+	_, err := client.conn.Write(b)
+	return err
+}
+
+// clientStream is how the contents are written to a kind of client
+type clientStream interface {
+	// the response, up to the content
+	header() string
+	// encode returns what the content is written as, nil for nothing
+	encode(c *PrintContent) []byte
+	// written to idle clients, nil for nothing
+	keepalive() []byte
+	// written when the server shuts down
+	end() []byte
+}
+
+// stream sends the backlog and then the contents to the client, until
+// it's dropped or leaves
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, st clientStream) {
+	client, lines, err := s.newServeClient(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	// the connection is taken over to be able to drop slow clients
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		debug(fmt.Sprintf("server: couldn't take over the connection: %s", err))
+		return
+	}
+	client.conn = conn
+	defer conn.Close()
+	defer s.remove(client)
+
+	debug(fmt.Sprintf("server: client %s connected to %s", conn.RemoteAddr(), r.URL.Path))
+	if err := client.write([]byte(st.header())); err != nil {
+		return
+	}
+
+	backlog := s.register(client, lines)
+	if _, ok := st.(*wsStream); ok {
+		go s.readWebSocket(client, rw.Reader)
+	}
+
+	for _, c := range backlog {
+		if b := st.encode(c); b != nil {
+			if err := client.write(b); err != nil {
+				return
+			}
+		}
+	}
+
+	keepalive := time.NewTicker(SERVE_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		var b []byte
+		select {
+		case c := <-client.queue:
+			b = st.encode(c)
+		case <-keepalive.C:
+			b = st.keepalive()
+		case <-client.gone:
+			if b := st.end(); b != nil {
+				_ = client.write(b)
+			}
+			return
+		}
+
+		if b == nil {
+			continue
+		}
+
+		if err := client.write(b); err != nil {
+			debug(fmt.Sprintf("server: client %s left: %s", conn.RemoteAddr(), err))
+			return
+		}
+	}
+}
+
+// handleEvents streams the lines as server-sent events, a json object
+// per line or event
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	s.stream(w, r, &sseStream{})
+}
+
+type sseStream struct{}
+
+func (st *sseStream) header() string {
+	return "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/event-stream\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n\r\n"
+}
+
+func (st *sseStream) encode(c *PrintContent) []byte {
+	var b []byte
+	for _, r := range jsonRecords(c) {
+		data, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+
+		b = append(b, "data: "...)
+		b = append(b, data...)
+		b = append(b, "\n\n"...)
+	}
+
+	return b
+}
+
+func (st *sseStream) keepalive() []byte {
+	return []byte(": ping\n\n")
+}
+
+func (st *sseStream) end() []byte {
+	return nil
+}
+
+// handleText streams the lines as plain text, for curl and the like.
+// Lines are prefixed with the name of the file when tailing several.
+// They're written to terminals, so their escape sequences are removed and
+// their control characters escaped.
+func (s *Server) handleText(w http.ResponseWriter, r *http.Request) {
+	s.stream(w, r, &textStream{
+		prefix:    len(s.files) > 1,
+		sanitizer: &Sanitizer{ansi: ANSI_STRIP},
+	})
+}
+
+type textStream struct {
+	prefix    bool
+	sanitizer *Sanitizer
+}
+
+func (st *textStream) header() string {
+	return "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Connection: close\r\n\r\n"
+}
+
+func (st *textStream) encode(c *PrintContent) []byte {
+	if c.event != "" {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, l := range c.lines {
+		if l.separator {
+			b.WriteString("--\n")
+			continue
+		}
+
+		if st.prefix {
+			b.WriteString(filepath.Base(c.filename) + " => ")
+		}
+		b.WriteString(st.sanitizer.sanitize(l.text) + "\n")
+	}
+
+	return chunk(b.String())
+}
+
+func (st *textStream) keepalive() []byte {
+	return nil
+}
+
+func (st *textStream) end() []byte {
+	return []byte("0\r\n\r\n")
+}
+
+// chunk frames the data as a chunk of a chunked response
+func chunk(data string) []byte {
+	if data == "" {
+		return nil
+	}
+
+	return []byte(fmt.Sprintf("%x\r\n%s\r\n", len(data), data))
+}
+
+// handleWebSocket streams the lines over a websocket, a json object per
+// message
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a websocket handshake", http.StatusBadRequest)
+		return
+	}
+
+	// browsers connect from any page, only the viewer's own is let in
+	if !sameOrigin(r) {
+		http.Error(w, "websocket from another origin", http.StatusForbidden)
+		return
+	}
+
+	h := sha1.New()
+	_, _ = io.WriteString(h, key+WEBSOCKET_GUID)
+	s.stream(w, r, &wsStream{accept: base64.StdEncoding.EncodeToString(h.Sum(nil))})
+}
+
+// sameOrigin checks that the origin of a browser request, if any, is the
+// host it was sent to
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+type wsStream struct {
+	// the accept key of the handshake
+	accept string
+}
+
+func (st *wsStream) header() string {
+	return "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + st.accept + "\r\n\r\n"
+}
+
+func (st *wsStream) encode(c *PrintContent) []byte {
+	var b []byte
+	for _, r := range jsonRecords(c) {
+		data, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+
+		b = append(b, wsFrame(WS_TEXT, data)...)
+	}
+
+	return b
+}
+
+func (st *wsStream) keepalive() []byte {
+	return wsFrame(WS_PING, nil)
+}
+
+func (st *wsStream) end() []byte {
+	return wsFrame(WS_CLOSE, nil)
+}
+
+// wsFrame frames the payload as a single, unmasked websocket frame
+func wsFrame(opcode byte, payload []byte) []byte {
+	b := []byte{0x80 | opcode}
+
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, byte(n))
+	case n <= 0xffff:
+		b = append(b, 126, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(n))
+	default:
+		b = append(b, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[2:], uint64(n))
+	}
+
+	return append(b, payload...)
+}
+
+// readWebSocket reads the frames of the client, answering pings and
+// dropping it once it closes the websocket. Messages are ignored.
+func (s *Server) readWebSocket(client *serveClient, r *bufio.Reader) {
+	defer s.remove(client)
+
+	for {
+		opcode, payload, err := readWSFrame(r)
+		if err != nil {
+			debug(fmt.Sprintf("server: websocket of %s closed: %s", client.conn.RemoteAddr(), err))
+			return
+		}
+
+		switch opcode {
+		case WS_CLOSE:
+			// the stream answers with a close frame as it ends
+			return
+		case WS_PING:
+			_ = client.write(wsFrame(WS_PONG, payload))
+		}
+	}
+}
+
+// readWSFrame reads a single frame sent by a client, unmasking it
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	opcode := head[0] & 0x0f
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// clients don't have anything to say but short control frames
+	if n > 1<<16 {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+// handleViewer serves the html viewer, streaming from /events with the
+// same query
+func (s *Server) handleViewer(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	colors := make(map[string]string)
+	for i, f := range s.files {
+		colors[f] = serveColors[i%len(serveColors)]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := viewerTemplate.Execute(w, map[string]interface{}{
+		"Files":  s.files,
+		"Colors": colors,
+	})
+	if err != nil {
+		debug(fmt.Sprintf("server: error while rendering the viewer: %s", err))
+	}
+}
+
+var viewerTemplate = template.Must(template.New("viewer").Funcs(template.FuncMap{
+	"base": filepath.Base,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tailf</title>
+<style>
+body { margin: 0; background: #1e2127; color: #abb2bf; font: 13px/1.4 monospace; }
+header { position: sticky; top: 0; padding: 6px 10px; background: #282c34; border-bottom: 1px solid #3e4451; }
+header input { width: 30em; background: #1e2127; color: inherit; border: 1px solid #3e4451; font: inherit; }
+header span { margin-left: 1em; }
+#lines { padding: 6px 10px; white-space: pre-wrap; word-break: break-all; }
+.file { font-weight: bold; }
+.event { color: #5c6370; font-style: italic; }
+.context { opacity: .6; }
+.warn { color: #e5c07b; }
+.error, .crit, .alert, .fatal { color: #e06c75; }
+.trace, .debug { color: #5c6370; }
+</style>
+</head>
+<body>
+<header>
+<input id="match" placeholder="match (regex)">
+<label><input id="follow" type="checkbox" checked> follow</label>
+{{range .Files}}<span class="file" style="color: {{index $.Colors .}}">{{base .}}</span>{{end}}
+<span id="state"></span>
+</header>
+<div id="lines"></div>
+<script>
+var colors = {{.Colors}};
+var multi = Object.keys(colors).length > 1;
+var lines = document.getElementById("lines");
+var state = document.getElementById("state");
+var follow = document.getElementById("follow");
+var match = document.getElementById("match");
+var params = new URLSearchParams(location.search);
+match.value = params.get("match") || "";
+var source;
+
+function add(r) {
+  var div = document.createElement("div");
+  if (r.type === "line") {
+    if (multi) {
+      var f = document.createElement("span");
+      f.className = "file";
+      f.style.color = colors[r.file];
+      f.textContent = r.file.split("/").pop() + " => ";
+      div.appendChild(f);
+    }
+    div.appendChild(document.createTextNode(r.line));
+    div.className = (r.level || "") + (r.context ? " context" : "");
+  } else if (r.type === "separator") {
+    div.textContent = "--";
+  } else {
+    div.className = "event";
+    div.textContent = r.file + " " + r.type + (r.summary ? " " + JSON.stringify(r.summary) : "");
+  }
+  lines.appendChild(div);
+  if (follow.checked) {
+    window.scrollTo(0, document.body.scrollHeight);
+  }
+}
+
+function connect() {
+  if (source) {
+    source.close();
+  }
+  if (match.value) {
+    params.set("match", match.value);
+  } else {
+    params.delete("match");
+  }
+  history.replaceState(null, "", "?" + params);
+  lines.textContent = "";
+  source = new EventSource("events?" + params);
+  source.onopen = function() { state.textContent = ""; };
+  source.onerror = function() { state.textContent = "disconnected"; };
+  source.onmessage = function(e) { add(JSON.parse(e.data)); };
+}
+
+match.addEventListener("change", connect);
+connect();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// contents waiting to be written to a sink. Sinks falling further
+	// behind lose the contents, except for the terminal.
+	SINK_QUEUE = 1024
+	// how long the sinks are waited for to write what's left, when
+	// tailing ends
+	SINK_CLOSE_TIMEOUT = 2 * time.Second
+	// the shortest wait between connection attempts of the unix socket
+	SINK_REDIAL = time.Second
+)
+
+// Sink is where the printed contents end up: the terminal, a file, a
+// syslog server, http clients or a unix socket
+type Sink interface {
+	// write takes in a content, it can be buffered
+	write(c *PrintContent) error
+	// flush writes out the buffered contents
+	flush() error
+	// close flushes and releases the sink
+	close() error
+}
+
+// newSink creates the sink of a --sink flag, one of file:<path> or
+// unix:<path>. Both get a json object per line or event.
+func newSink(spec string) (Sink, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return newFileSink(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "unix:"):
+		return newUnixSink(strings.TrimPrefix(spec, "unix:"))
+	default:
+		return nil, fmt.Errorf("unknown sink %s, expected file:<path> or unix:<path>", spec)
+	}
+}
+
+// Fanout hands the contents to all the sinks. Each sink writes from a
+// queue of its own, so a slow or broken one holds back none of the
+// others.
+type Fanout struct {
+	sync.Mutex
+	runners []*sinkRunner
+	// receives the exit code once the lines ending tailing are written
+	quit chan<- int
+	// written to by the runners once they wrote the lines ending tailing
+	acks chan struct{}
+	// whether the lines ending tailing came, and whether the sinks are
+	// closed
+	stopped bool
+	closed  bool
+	// closed as the sinks are about to be, stops waiting on a blocking
+	// sink
+	closing chan struct{}
+}
+
+func newFanout(quit chan<- int) *Fanout {
+	return &Fanout{quit: quit, closing: make(chan struct{})}
+}
+
+// sinkRunner writes the contents of its queue to a sink
+type sinkRunner struct {
+	name  string
+	sink  Sink
+	queue chan *PrintContent
+	// whether the contents wait for room in the queue, rather than
+	// being dropped
+	blocking bool
+	// contents dropped, and whether the last write failed
+	dropped int
+	failing bool
+	// closed once the queue is drained after closing
+	finished chan struct{}
+	fanout   *Fanout
+}
+
+// add adds a sink and starts writing to it. Contents wait for a
+// blocking sink to catch up, the terminal and --tee are.
+func (f *Fanout) add(name string, sink Sink, blocking bool) {
+	r := &sinkRunner{
+		name:     name,
+		sink:     sink,
+		queue:    make(chan *PrintContent, SINK_QUEUE),
+		blocking: blocking,
+		finished: make(chan struct{}),
+		fanout:   f,
+	}
+
+	f.runners = append(f.runners, r)
+	f.acks = make(chan struct{}, len(f.runners))
+	go r.run()
+}
+
+// start hands the contents to the sinks until shutdown
+func (f *Fanout) start(contents <-chan *PrintContent, done <-chan bool) {
+	for {
+		select {
+		case c := <-contents:
+			debug(fmt.Sprintf("fanout: received print content for file %s", c.filename))
+			f.send(c)
+		case <-done:
+			debug("fanout: received notice to shutdown")
+			return
+		}
+	}
+}
+
+// send queues the content for each of the sinks. Nothing is sent after
+// the lines ending tailing. Waiting on a blocking sink stops once the
+// sinks are closing.
+func (f *Fanout) send(c *PrintContent) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.stopped || f.closed {
+		return
+	}
+
+	// the sinks the content is queued for
+	queued := 0
+	for _, r := range f.runners {
+		if r.blocking {
+			select {
+			case r.queue <- c:
+				queued++
+			case <-f.closing:
+				return
+			}
+			continue
+		}
+
+		select {
+		case r.queue <- c:
+			queued++
+		default:
+			if r.dropped++; r.dropped == 1 {
+				printErr(fmt.Sprintf("%s: can't keep up, dropping lines", r.name))
+			}
+		}
+	}
+
+	if c.stop {
+		f.stopped = true
+		go f.waitStop(c.exitCode, queued)
+	}
+}
+
+// waitStop tells the exit code once the sinks the lines ending tailing
+// were queued for wrote them, or they took too long to
+func (f *Fanout) waitStop(exitCode int, queued int) {
+	timeout := time.After(SINK_CLOSE_TIMEOUT)
+
+wait:
+	for i := 0; i < queued; i++ {
+		select {
+		case <-f.acks:
+		case <-timeout:
+			debug("fanout: gave up on the sinks writing the last lines")
+			break wait
+		}
+	}
+
+	f.quit <- exitCode
+}
+
+// close lets the sinks write what's left in their queue and closes
+// them. Sinks that take too long are left behind.
+func (f *Fanout) close() {
+	close(f.closing)
+
+	f.Lock()
+	f.closed = true
+	for _, r := range f.runners {
+		close(r.queue)
+	}
+	f.Unlock()
+
+	timeout := time.After(SINK_CLOSE_TIMEOUT)
+	for _, r := range f.runners {
+		select {
+		case <-r.finished:
+			r.report(r.sink.close())
+		case <-timeout:
+			debug(fmt.Sprintf("fanout: gave up on %s", r.name))
+		}
+	}
+}
+
+// run writes the contents of the queue, flushing whenever it's empty
+func (r *sinkRunner) run() {
+	defer close(r.finished)
+
+	for c := range r.queue {
+		r.report(r.sink.write(c))
+		if len(r.queue) == 0 || c.stop {
+			r.report(r.sink.flush())
+		}
+
+		if c.stop {
+			select {
+			case r.fanout.acks <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// report tells about the sink failing, once until it recovers
+func (r *sinkRunner) report(err error) {
+	if err == nil {
+		if r.failing {
+			debug(fmt.Sprintf("%s: recovered", r.name))
+		}
+		r.failing = false
+		return
+	}
+
+	if !r.failing {
+		printErr(fmt.Sprintf("%s: %s", r.name, err))
+	}
+	r.failing = true
+}
+
+// writeRecords writes the json objects of the content, one per line
+func writeRecords(w *bufio.Writer, c *PrintContent) error {
+	for _, r := range jsonRecords(c) {
+		b, err := json.Marshal(r)
+		if err != nil {
+			debug(fmt.Sprintf("sink: error while marshalling json: %s", err))
+			continue
+		}
+
+		b = append(b, '\n')
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileSink appends the contents to a file, as json
+type fileSink struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (s *fileSink) write(c *PrintContent) error {
+	return writeRecords(s.w, c)
+}
+
+func (s *fileSink) flush() error {
+	return s.w.Flush()
+}
+
+func (s *fileSink) close() error {
+	if err := s.flush(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
+
+// unixSink sends the contents to a unix socket, as json. The contents
+// are dropped while nothing listens on it.
+type unixSink struct {
+	path string
+	conn net.Conn
+	w    *bufio.Writer
+	// when it was last connected to
+	dialed time.Time
+}
+
+// newUnixSink creates a sink for the socket, connecting to it on the
+// first write
+func newUnixSink(path string) (*unixSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing the path of the unix socket")
+	}
+
+	return &unixSink{path: path}, nil
+}
+
+func (s *unixSink) write(c *PrintContent) error {
+	if s.conn == nil {
+		// not dialing for every line while it's down
+		if time.Since(s.dialed) < SINK_REDIAL {
+			return nil
+		}
+		s.dialed = time.Now()
+
+		conn, err := net.DialTimeout("unix", s.path, SINK_REDIAL)
+		if err != nil {
+			return err
+		}
+
+		debug(fmt.Sprintf("sink: connected to %s", s.path))
+		s.conn = conn
+		s.w = bufio.NewWriter(conn)
+	}
+
+	if err := writeRecords(s.w, c); err != nil {
+		s.disconnect()
+		return err
+	}
+
+	return nil
+}
+
+func (s *unixSink) flush() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := s.w.Flush(); err != nil {
+		s.disconnect()
+		return err
+	}
+
+	return nil
+}
+
+func (s *unixSink) disconnect() {
+	_ = s.conn.Close()
+	s.conn = nil
+}
+
+func (s *unixSink) close() error {
+	err := s.flush()
+	if s.conn != nil {
+		s.disconnect()
+	}
+
+	return err
+}
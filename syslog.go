@@ -0,0 +1,278 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// syslog facilities, by their number
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+
+	// syslog severity keywords, by their number
+	syslogSeverityNames = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
+
+	// timestamps of syslog lines, either RFC 3339 as in RFC 5424 and the
+	// rsyslog file format, or the BSD one of RFC 3164. Years and fractions
+	// of seconds some daemons add to the BSD timestamp are accepted too.
+	syslogISOTime = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?`)
+	syslogBSDTime = regexp.MustCompile(`^(?:\d{4} )?[A-Z][a-z]{2} {1,2}\d{1,2}(?: \d{4})? \d{2}:\d{2}:\d{2}(?:\.\d+)?`)
+	// the double space before single digit days of the BSD timestamp
+	syslogSpaces = regexp.MustCompile(` +`)
+)
+
+// syslogParser parses syslog lines, in the RFC 5424 format
+//
+//	<165>1 2019-06-01T10:00:00.003Z host app 1234 ID47 [ex@32473 iut="3"] msg
+//
+// or the RFC 3164 (BSD) one, with or without the priority, as written to
+// /var/log/syslog and /var/log/messages
+//
+//	<34>Jun  1 10:00:00 host sshd[1234]: Accepted publickey for ...
+//	2019-06-01T10:00:00.123456+02:00 host sshd[1234]: Accepted ...
+//
+// The fields are time, host, app, pid, msgid, facility, severity and
+// msg. Structured data params are given as sdid.name fields.
+type syslogParser struct{}
+
+func (p *syslogParser) parse(line string) (*Record, bool) {
+	r := &Record{Format: "syslog"}
+	s := line
+
+	pri, n := syslogPriority(s)
+	if n > 0 {
+		r.Fields = append(r.Fields,
+			Field{Key: "facility", Value: syslogFacility(pri)},
+			Field{Key: "severity", Value: syslogSeverityNames[pri%8]})
+		s = s[n:]
+	}
+
+	var ok bool
+	if n > 0 && strings.HasPrefix(s, "1 ") {
+		// the version of RFC 5424
+		ok = parse5424(r, s[2:])
+	} else {
+		ok = parse3164(r, s, n > 0)
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	return r, true
+}
+
+// syslogPriority reads the <priority> a line starts with, and its length.
+// Returns a length of 0 if there's none
+func syslogPriority(s string) (int, int) {
+	if !strings.HasPrefix(s, "<") {
+		return 0, 0
+	}
+
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return 0, 0
+	}
+
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, 0
+	}
+
+	return pri, end + 1
+}
+
+// syslogFacility returns the name of the facility of the priority
+func syslogFacility(pri int) string {
+	if f := pri / 8; f < len(syslogFacilities) {
+		return syslogFacilities[f]
+	}
+
+	return strconv.Itoa(pri / 8)
+}
+
+// parse5424 parses what follows the version of a RFC 5424 line, ie:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG. A dash
+// stands for a missing value.
+func parse5424(r *Record, s string) bool {
+	header := []string{"time", "host", "app", "pid", "msgid"}
+	fields := make([]Field, 0, len(header))
+	for _, key := range header {
+		end := strings.IndexByte(s, ' ')
+		if end < 0 {
+			return false
+		}
+
+		if v := s[:end]; v != "-" {
+			fields = append(fields, Field{Key: key, Value: v})
+		}
+		s = s[end+1:]
+	}
+
+	// time and host come first, as they do in the line
+	r.Fields = append(fields, r.Fields...)
+
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	} else {
+		sd, rest, ok := parseStructuredData(s)
+		if !ok {
+			return false
+		}
+
+		r.Fields = append(r.Fields, sd...)
+		s = rest
+	}
+
+	if strings.HasPrefix(s, " ") {
+		// the message might start with a BOM to tell it's UTF-8
+		msg := strings.TrimPrefix(s[1:], "\ufeff")
+		r.Fields = append(r.Fields, Field{Key: "msg", Value: msg})
+	} else if s != "" {
+		return false
+	}
+
+	return true
+}
+
+// parseStructuredData parses the [id name="value" ...] elements at the
+// start of the string, returning their params and what follows them
+func parseStructuredData(s string) ([]Field, string, bool) {
+	fields := make([]Field, 0)
+	for strings.HasPrefix(s, "[") {
+		end := strings.IndexAny(s, " ]")
+		if end < 2 {
+			return nil, "", false
+		}
+
+		id := s[1:end]
+		s = s[end:]
+
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+
+			eq := strings.Index(s, "=\"")
+			if eq < 1 {
+				return nil, "", false
+			}
+
+			name := s[:eq]
+			s = s[eq+2:]
+
+			// values escape ", \ and ] with a backslash
+			var v strings.Builder
+			i := 0
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i++
+				}
+				v.WriteByte(s[i])
+			}
+
+			if i >= len(s) {
+				return nil, "", false
+			}
+
+			fields = append(fields, Field{Key: id + "." + name, Value: v.String()})
+			s = s[i+1:]
+		}
+
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", false
+		}
+		s = s[1:]
+	}
+
+	return fields, s, true
+}
+
+// parse3164 parses a BSD syslog line, without its priority, ie:
+// TIMESTAMP HOSTNAME TAG[PID]: MSG. The many variants rsyslog and others
+// write are accepted: RFC 3339 timestamps, a missing host or pid, or no
+// tag at all.
+func parse3164(r *Record, s string, hasPriority bool) bool {
+	fields := make([]Field, 0, 4)
+
+	if ts := syslogISOTime.FindString(s); ts != "" {
+		fields = append(fields, Field{Key: "time", Value: ts})
+		s = s[len(ts):]
+	} else if ts := syslogBSDTime.FindString(s); ts != "" {
+		fields = append(fields, Field{Key: "time", Value: syslogSpaces.ReplaceAllString(ts, " ")})
+		s = s[len(ts):]
+	} else if !hasPriority {
+		// without a priority or a timestamp, there's no telling it's
+		// syslog
+		return false
+	}
+
+	if len(fields) > 0 {
+		if !strings.HasPrefix(s, " ") {
+			return false
+		}
+		s = s[1:]
+
+		// the host is left out by some daemons, the first word is the
+		// tag then
+		if end := strings.IndexByte(s, ' '); end > 0 && !isSyslogTag(s[:end]) {
+			fields = append(fields, Field{Key: "host", Value: s[:end]})
+			s = s[end+1:]
+		}
+	}
+
+	if app, pid, n := syslogTag(s); n > 0 {
+		fields = append(fields, Field{Key: "app", Value: app})
+		if pid != "" {
+			fields = append(fields, Field{Key: "pid", Value: pid})
+		}
+		s = strings.TrimPrefix(s[n:], " ")
+	}
+
+	r.Fields = append(fields, r.Fields...)
+	r.Fields = append(r.Fields, Field{Key: "msg", Value: s})
+
+	return true
+}
+
+// isSyslogTag checks if the word is a tag, ie: sshd[123]: or cron:
+func isSyslogTag(w string) bool {
+	_, _, n := syslogTag(w)
+	return n == len(w)
+}
+
+// syslogTag reads the TAG[PID]: the string starts with, returning the
+// app, the pid and the length of the tag. Returns a length of 0 if
+// there's none
+func syslogTag(s string) (string, string, int) {
+	i := 0
+	for i < len(s) && s[i] != ':' && s[i] != '[' && s[i] != ' ' {
+		i++
+	}
+
+	if i == 0 || i >= len(s) {
+		return "", "", 0
+	}
+
+	app, pid := s[:i], ""
+	if s[i] == '[' {
+		end := strings.IndexByte(s[i:], ']')
+		if end < 0 {
+			return "", "", 0
+		}
+
+		pid = s[i+1 : i+end]
+		i += end + 1
+	}
+
+	if i >= len(s) || s[i] != ':' {
+		return "", "", 0
+	}
+
+	return app, pid, i + 1
+}
@@ -6,10 +6,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// how long an incomplete line waits for the rest of it before it's shown
+// as it is, ie: the last line of a file that doesn't end with a new line
+const PENDING_TIMEOUT = 500 * time.Millisecond
+
 // structure to collect tailing file info
 type FileTailer struct {
 	name     string
@@ -19,6 +24,38 @@ type FileTailer struct {
 	fd       int
 	contentQ chan<- *PrintContent
 	color    func(string) string
+	encoding *Encoding
+	decoder  *Decoder
+	// content of an incomplete line, waiting for the rest of it, and
+	// when it was last written to
+	pending   []byte
+	pendingAt time.Time
+	// decides which lines are shown, nil to show everything
+	filter *LineFilter
+	// lines around the filter matches, nil if no context is shown
+	context *lineContext
+	// extracts fields out of structured lines, nil for plain text
+	parser Parser
+	// finds the level of the lines, nil if not needed
+	levelDetector LevelDetector
+	// counts the requests of access logs, nil if not needed
+	stats *AccessStats
+	// commands run on matching lines
+	exec []*ExecRule
+	// notifies of lines matching the alert rules, nil if there are none
+	alerts *Alerts
+	// ends tailing when a line matches, nil if not needed
+	exitWatch *ExitWatch
+	// counts the lines, bytes and events of the file
+	metrics *FileMetrics
+	// counts the lines matching the metric rules
+	metricRules []*MetricRule
+	// inode of the file currently open
+	inode uint64
+	// whether line numbers are tracked, and the number of the next line
+	// to be read
+	lineNumbers bool
+	lineNo      int64
 }
 
 func newFileTailer(fd int, name string, content chan<- *PrintContent, c func(string) string) *FileTailer {
@@ -27,11 +64,72 @@ func newFileTailer(fd int, name string, content chan<- *PrintContent, c func(str
 		fd:       fd,
 		contentQ: content,
 		color:    c,
+		metrics:  newFileMetrics(name),
 	}
 
+	// plain UTF-8 unless told otherwise
+	enc, _ := newEncoding("auto")
+	t.setEncoding(enc, false)
+
 	return t
 }
 
+// setEncoding sets the character encoding the file content is decoded
+// from, and whether CRLF line endings should be normalized to LF
+func (t *FileTailer) setEncoding(enc *Encoding, crlf bool) {
+	t.encoding = enc
+	t.decoder = newDecoder(enc, crlf)
+
+	if t.file != nil {
+		t.detectEncoding()
+	}
+}
+
+// detectEncoding checks the BOM of the current file and drops any
+// incomplete line from before. The encoding might change if it's
+// decided by the BOM.
+func (t *FileTailer) detectEncoding() {
+	t.encoding.detect(t.file)
+	t.decoder.reset()
+	t.pending = nil
+}
+
+// keepLine checks if the given raw line, without its new line, passes
+// the filter of the tailer
+func (t *FileTailer) keepLine(b []byte) bool {
+	if t.filter == nil {
+		return true
+	}
+
+	return t.filter.matches(t.newLine(b, 0))
+}
+
+// newLine decodes the given raw line, without its new line, and parses
+// its fields and level
+func (t *FileTailer) newLine(b []byte, offset int64) *Line {
+	l := &Line{
+		text:   t.decodeLine(b),
+		offset: offset,
+	}
+
+	if t.parser != nil {
+		l.record, _ = t.parser.parse(l.text)
+	}
+
+	if t.levelDetector != nil {
+		l.level, _ = t.levelDetector.detect(l)
+	}
+
+	return l
+}
+
+// decodeLine decodes the given raw line, without its new line. The
+// line is decoded along with its new line so that a CRLF is normalized.
+func (t *FileTailer) decodeLine(b []byte) string {
+	line := append(b[:len(b):len(b)], t.encoding.newline...)
+	return strings.TrimSuffix(t.decoder.decode(line), "\n")
+}
+
 // refresh closes the existing filehandler and opens a new one. It
 // also closes the Inotify watch opened for the older filehandler
 // and opens a new one.
@@ -51,6 +149,7 @@ func (t *FileTailer) refresh() error {
 	}
 
 	t.file = f
+	t.inode = inodeOf(f)
 	err = t.registerWatch()
 	//if err != nil {
 	//	return err
@@ -65,6 +164,40 @@ func (t *FileTailer) openFile() {
 	handleErrorAndExit(err, fmt.Sprintf("error while opening file: %s", t.name))
 
 	t.file = f
+	t.inode = inodeOf(f)
+	t.detectEncoding()
+}
+
+// countLines sets the line number of the next line to be read by
+// counting the lines up to the current cursor position. Only done if
+// line numbers are tracked, since it reads the whole file up to the
+// cursor.
+func (t *FileTailer) countLines() {
+	if !t.lineNumbers {
+		return
+	}
+
+	curPos, err := t.file.Seek(0, io.SeekCurrent)
+	handleErrorAndExit(err, "error while getting current cursor pos")
+
+	n, err := countLines(t.file, t.encoding, curPos)
+	handleErrorAndExit(err, fmt.Sprintf("error while counting lines: %s", t.name))
+
+	t.lineNo = n + 1
+}
+
+// event creates a PrintContent without any lines, informing of
+// something that happened to the file
+func (t *FileTailer) event(e string) *PrintContent {
+	t.metrics.event(e)
+
+	return &PrintContent{
+		filename: t.name,
+		color:    t.color,
+		inode:    t.inode,
+		readAt:   time.Now(),
+		event:    e,
+	}
 }
 
 // registerWatch adds an Inotify watch on the file currently in use
@@ -114,8 +247,11 @@ func (t *FileTailer) processEvent(e syscall.InotifyEvent) (uint32, error) {
 		if finfo.Size() < t.fileSize {
 			debug(fmt.Sprintf("tailer %d: FILE TRUNCATED", t.wd))
 
-			// file has been truncated, go to the beginning
+			// file has been truncated, go to the beginning. What's
+			// left of the last line won't be written anymore
+			t.sendPending()
 			_, _ = t.file.Seek(0, io.SeekStart)
+			t.contentQ <- t.event(EVENT_TRUNCATED)
 		} else if finfo.Size() > t.fileSize {
 			// file has been written into, ie "write()"
 			// no need to seek anywhere
@@ -150,6 +286,9 @@ func (t *FileTailer) processEvent(e syscall.InotifyEvent) (uint32, error) {
 			time.Sleep(2 * time.Second)
 		}
 
+		// the last line of the old file is done with
+		t.sendPending()
+
 		// file appeared, open a new file handler and
 		// refresh Inotify watch
 		err := t.refresh()
@@ -157,6 +296,8 @@ func (t *FileTailer) processEvent(e syscall.InotifyEvent) (uint32, error) {
 			return 0, err
 		}
 
+		t.contentQ <- t.event(EVENT_ROTATED)
+
 		// show any content created during the timeout
 		// also reset last read file size
 		t.contentQ <- t.readFile()
@@ -173,6 +314,8 @@ func (t *FileTailer) processEvent(e syscall.InotifyEvent) (uint32, error) {
 			debug(fmt.Sprintf("tailer %d: FILE DELETED, TIME TO DIE", t.wd))
 			// end the watch cycle, and possibly the
 			// invoking goroutine
+			t.sendPending()
+			t.contentQ <- t.event(EVENT_DELETED)
 			return 0, errors.New("file deleted")
 		}
 
@@ -183,6 +326,8 @@ func (t *FileTailer) processEvent(e syscall.InotifyEvent) (uint32, error) {
 		// end the watch cycle, and possibly the
 		// invoking goroutine
 		//return t.wd, nil
+		t.sendPending()
+		t.contentQ <- t.event(EVENT_DELETED)
 		return 0, errors.New("file deleted")
 	}
 
@@ -191,21 +336,40 @@ func (t *FileTailer) processEvent(e syscall.InotifyEvent) (uint32, error) {
 
 // readFile reads the file from the current cursor position to the end
 // of file. The current file size is updated at the same time of the
-// read.
-// Returns a PrintContent struct with the read content, the filename,
-// and the color to be printed with. This method can be used directly
-// to feed a ContentPrinter.
+// read. The content is split into lines, an incomplete line at the end
+// is held back until the rest of it is read, or PENDING_TIMEOUT passes.
+// Returns a PrintContent struct with the lines that pass the filter,
+// the filename, and the color to be printed with. This method can be
+// used directly to feed a ContentPrinter.
 func (t *FileTailer) readFile() *PrintContent {
 	// get current position
 	curPos, err := t.file.Seek(0, io.SeekCurrent)
 	handleErrorAndExit(err, "error while getting current cursor pos")
 
+	// reading from the start, ex: a new or a truncated file. Check the
+	// BOM again and skip past it
+	if curPos == 0 {
+		t.detectEncoding()
+		if t.context != nil {
+			t.context.reset()
+		}
+
+		curPos, err = t.file.Seek(t.encoding.bom, io.SeekStart)
+		handleErrorAndExit(err, "error while skipping BOM")
+		t.lineNo = 1
+	}
+
+	readAt := time.Now()
+
 	finfo, err := os.Stat(t.file.Name())
 	handleErrorAndExit(err, "error while getting filesize")
 
 	// len to read is total file size - current position
 	t.fileSize = finfo.Size()
 	buflen := t.fileSize - curPos
+	if buflen < 0 {
+		buflen = 0
+	}
 
 	buf := make([]byte, buflen)
 	n, err := t.file.Read(buf)
@@ -215,12 +379,122 @@ func (t *FileTailer) readFile() *PrintContent {
 	}
 
 	debug(fmt.Sprintf("tailer %d: read %d bytes from %s", t.wd, buflen, t.file.Name()))
+	t.metrics.read(n, curPos+int64(n))
+
+	// continue the incomplete line from the last read
+	offset := curPos - int64(len(t.pending))
+	data := append(t.pending, buf[:n]...)
+	raw, used := t.encoding.splitLines(data, offset)
+	t.pending = append([]byte{}, data[used:]...)
+	if len(t.pending) > 0 && n > 0 {
+		t.pendingAt = readAt
+	}
 
-	return &PrintContent{
-		content:  string(buf[:n]),
+	return t.processLines(raw, offset, readAt)
+}
+
+// flushPending returns the incomplete line as a line of its own once
+// nothing was written to it for PENDING_TIMEOUT, or right away if
+// forced. Returns nil if there's nothing to show yet.
+func (t *FileTailer) flushPending(force bool) *PrintContent {
+	if len(t.pending) == 0 {
+		return nil
+	}
+
+	if !force && (time.Since(t.pendingAt) < PENDING_TIMEOUT || len(t.pending)%t.encoding.unit != 0) {
+		return nil
+	}
+
+	debug(fmt.Sprintf("tailer %d: showing the incomplete line of %s", t.wd, t.file.Name()))
+
+	curPos, err := t.file.Seek(0, io.SeekCurrent)
+	handleErrorAndExit(err, "error while getting current cursor pos")
+
+	raw := t.pending
+	t.pending = nil
+
+	return t.processLines([][]byte{raw}, curPos-int64(len(raw)), time.Now())
+}
+
+// sendPending shows the incomplete line right away, ie: when the file
+// is truncated or replaced
+func (t *FileTailer) sendPending() {
+	if c := t.flushPending(true); c != nil {
+		t.contentQ <- c
+	}
+}
+
+// processLines turns the raw lines, starting at the given offset, into
+// a PrintContent with the lines to be shown. The lines go through the
+// filter, the rules and the alerts on the way.
+func (t *FileTailer) processLines(raw [][]byte, offset int64, readAt time.Time) *PrintContent {
+	c := &PrintContent{
+		lines:    make([]*Line, 0, len(raw)),
 		filename: t.file.Name(),
 		color:    t.color,
+		inode:    t.inode,
+		readAt:   readAt,
+	}
+
+	for _, r := range raw {
+		l := t.newLine(r, offset)
+		offset += int64(len(r) + len(t.encoding.newline))
+
+		if t.stats != nil {
+			t.stats.add(l.record)
+		}
+
+		if t.lineNumbers {
+			l.lineNo = t.lineNo
+			t.lineNo++
+		}
+
+		matched := t.filter == nil || t.filter.matches(l)
+		t.metrics.line(matched, readAt.UnixNano())
+		for _, r := range t.metricRules {
+			r.check(t.file.Name(), l)
+		}
+
+		if matched {
+			for _, r := range t.exec {
+				r.check(t.file.Name(), l)
+			}
+		}
+
+		if t.alerts != nil {
+			t.alerts.check(t.file.Name(), l, matched, readAt)
+		}
+
+		if t.context != nil {
+			c.lines = append(c.lines, t.context.process(l, matched)...)
+		} else if matched {
+			c.lines = append(c.lines, l)
+		}
+
+		// the rest of the lines aren't needed if tailing ends here
+		if t.exitWatch != nil {
+			if code, ok := t.exitWatch.check(l); ok {
+				c.stop, c.exitCode = true, code
+				break
+			}
+		}
 	}
+
+	return c
+}
+
+// inodeOf returns the inode number of the given file, 0 if unknown
+func inodeOf(f *os.File) uint64 {
+	finfo, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+
+	if st, ok := finfo.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+
+	return 0
 }
 
 // close removes the Inotify watch and closes the file handler. This is
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layout of the time rotated files are suffixed with, ie:
+// out.log.20190601-100000.000
+const TEE_ROTATED_LAYOUT = "20060102-150405.000"
+
+// teeSink writes the lines to a file as they're printed, without colors.
+// The file is rotated by size or by time.
+type teeSink struct {
+	printer *ContentPrinter
+	file    *RotatingFile
+}
+
+// newTeeSink creates a sink printing like the given printer to the file
+func newTeeSink(p *ContentPrinter, file *RotatingFile) *teeSink {
+	tee := *p
+	tee.out = bufio.NewWriter(file)
+	tee.plain = true
+	tee.levelColors = false
+
+	return &teeSink{printer: &tee, file: file}
+}
+
+// write prints the content, to a new file if the current one is due to
+// be rotated. Files are only rotated between contents, so that lines
+// aren't split across them
+func (s *teeSink) write(c *PrintContent) error {
+	var err error
+	if s.file.due() {
+		if err = s.printer.flush(); err == nil {
+			err = s.file.rotate()
+		}
+	}
+
+	s.printer.print(c)
+	return err
+}
+
+func (s *teeSink) flush() error {
+	return s.printer.flush()
+}
+
+func (s *teeSink) close() error {
+	if err := s.printer.flush(); err != nil {
+		_ = s.file.close()
+		return err
+	}
+
+	return s.file.close()
+}
+
+// RotatingFile is a file that's moved aside once it grows over a size
+// or gets old, and replaced with a new one. The rotated files are
+// optionally gzipped, and only the latest ones kept.
+type RotatingFile struct {
+	path string
+	file *os.File
+	// size of the file, and when it was opened
+	size   int64
+	opened time.Time
+	// the file is rotated once it's over this size, 0 for never
+	maxSize int64
+	// or once it's open for this long, 0 for never
+	interval time.Duration
+	// whether the rotated files are gzipped
+	compress bool
+	// rotated files kept, 0 to keep all of them
+	keep int
+	// the rotated file being gzipped, in the background so that the
+	// lines keep being written
+	compressing sync.WaitGroup
+}
+
+// newRotatingFile opens the file, appending to it if it exists
+func newRotatingFile(path string, maxSize int64, interval time.Duration, compress bool, keep int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		interval: interval,
+		compress: compress,
+		keep:     keep,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// due checks if the file is over the size or too old, and isn't empty
+func (f *RotatingFile) due() bool {
+	if f.size == 0 {
+		return false
+	}
+
+	return (f.maxSize > 0 && f.size >= f.maxSize) || (f.interval > 0 && time.Since(f.opened) >= f.interval)
+}
+
+// rotate moves the file aside, suffixed with the time, and opens a new
+// one in its place
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := f.path + "." + time.Now().Format(TEE_ROTATED_LAYOUT)
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, time.Now().Format(TEE_ROTATED_LAYOUT), i)
+	}
+
+	debug(fmt.Sprintf("tee: rotating %s to %s", f.path, rotated))
+	if err := os.Rename(f.path, rotated); err != nil {
+		// keep writing to the same file
+		if oerr := f.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	if !f.compress {
+		return f.prune()
+	}
+
+	// one at a time, the files to prune are known once it's gzipped
+	f.compressing.Wait()
+	f.compressing.Add(1)
+	go func() {
+		defer f.compressing.Done()
+
+		if err := gzipFile(rotated); err != nil {
+			printErr(fmt.Sprintf("tee: couldn't gzip %s: %s", rotated, err))
+		}
+
+		if err := f.prune(); err != nil {
+			printErr(fmt.Sprintf("tee: %s", err))
+		}
+	}()
+
+	return nil
+}
+
+// prune removes the oldest rotated files, over the count to keep
+func (f *RotatingFile) prune() error {
+	if f.keep == 0 {
+		return nil
+	}
+
+	rotated, err := filepath.Glob(escapeGlob(f.path) + ".[0-9]*")
+	if err != nil {
+		return err
+	}
+
+	// by the time they were rotated at, and in the order of the ones
+	// rotated within the same millisecond
+	sort.Slice(rotated, func(i, j int) bool {
+		ti, ni := rotatedAt(f.path, rotated[i])
+		tj, nj := rotatedAt(f.path, rotated[j])
+		if ti != tj {
+			return ti < tj
+		}
+
+		return ni < nj
+	})
+	for len(rotated) > f.keep {
+		debug(fmt.Sprintf("tee: removing %s", rotated[0]))
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+// rotatedAt returns the time suffix of a rotated file, which sorts like
+// the time, and its number if others were rotated at the same time, ie:
+// 20190601-100000.000 and 1 for out.log.20190601-100000.000-1.gz
+func rotatedAt(path string, rotated string) (string, int) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(rotated, path+"."), ".gz")
+	if len(suffix) <= len(TEE_ROTATED_LAYOUT) {
+		return suffix, 0
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(suffix[len(TEE_ROTATED_LAYOUT):], "-"))
+	if err != nil {
+		return suffix, 0
+	}
+
+	return suffix[:len(TEE_ROTATED_LAYOUT)], n
+}
+
+// close closes the file, once the last rotated one is gzipped
+func (f *RotatingFile) close() error {
+	f.compressing.Wait()
+	return f.file.Close()
+}
+
+// escapeGlob escapes the characters of the path that have a meaning in
+// a glob pattern
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// gzipFile compresses the file to <path>.gz, and removes it
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// exists checks if there's a file at the path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
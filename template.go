@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// output format when tailing a single file
+	DEFAULT_TEMPLATE = `{{.Line}}`
+	// output format when tailing multiple files, prefixes the file name
+	DEFAULT_MULTI_FILE_TEMPLATE = `{{printf "%s => " .Base | .Color}} {{.Line}}`
+)
+
+// helper functions available in the templates
+var templateFuncs = template.FuncMap{
+	// pad right pads the value with spaces up to the given width
+	"pad": func(w int, v interface{}) string {
+		return padRight(fmt.Sprint(v), w)
+	},
+	// lpad left pads the value with spaces up to the given width
+	"lpad": func(w int, v interface{}) string {
+		s := fmt.Sprint(v)
+		if n := visibleLen(s); n < w {
+			return strings.Repeat(" ", w-n) + s
+		}
+		return s
+	},
+	// trunc cuts the value down to the given number of characters
+	"trunc": func(w int, v interface{}) string {
+		s := fmt.Sprint(v)
+		if utf8.RuneCountInString(s) <= w {
+			return s
+		}
+		r := []rune(s)
+		return string(r[:w])
+	},
+	// ftime formats the time with the given Go time layout
+	"ftime": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	// style applies a comma separated list of styles, ie: bold,red
+	"style": func(s string, str string) (string, error) {
+		st, err := parseStyle(s)
+		if err != nil {
+			return "", err
+		}
+		return st.apply(str), nil
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// lineData is what a template is executed with, for each printed line
+type lineData struct {
+	// absolute path of the file
+	File string
+	// base name of the file
+	Base string
+	// the line, ready to be printed
+	Line string
+	// line number in the file, 0 if not known
+	LineNo int64
+	// file offset the line starts at
+	Offset int64
+	// when the line was read
+	Time time.Time
+	// set for lines shown as context around a filter match
+	Context bool
+	// level of the line, empty if not known
+	Level string
+	// fields of structured lines by their key, ie: {{.Fields.app}}
+	Fields map[string]string
+	color  func(string) string
+}
+
+// Color colors the given string with the color of the file
+func (d *lineData) Color(s string) string {
+	return d.color(s)
+}
+
+// newLineTemplate parses the given output template
+func newLineTemplate(s string) (*template.Template, error) {
+	// missing fields are printed as empty strings
+	return template.New("line").Funcs(templateFuncs).Option("missingkey=zero").Parse(s)
+}
+
+// render executes the template for the given line of the given
+// PrintContent
+func render(tmpl *template.Template, c *PrintContent, l *Line, text string) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, &lineData{
+		File:    c.filename,
+		Base:    filepath.Base(c.filename),
+		Line:    text,
+		LineNo:  l.lineNo,
+		Offset:  l.offset,
+		Time:    c.readAt,
+		Context: l.context,
+		Level:   levelLabel(l.level),
+		Fields:  fieldMap(l.record),
+		color:   c.color,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error while rendering template: %s", err)
+	}
+
+	return buf.String(), nil
+}
+
+// fieldMap returns the fields of the record by their key, the first
+// one wins if a key is repeated. The map is empty for a nil record
+func fieldMap(r *Record) map[string]string {
+	m := make(map[string]string)
+	if r == nil {
+		return m
+	}
+
+	for _, f := range r.Fields {
+		if _, ok := m[f.Key]; !ok {
+			m[f.Key] = f.Value
+		}
+	}
+
+	return m
+}
+
+// visibleLen counts the characters of the string that take up space on
+// the terminal, skipping ANSI escape sequences
+func visibleLen(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		if l := ansiSequenceLen(s[i:]); l > 0 {
+			i += l
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		n++
+	}
+
+	return n
+}
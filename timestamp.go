@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timestamp formats that aren't Go time layouts
+const (
+	// time since the previous line was read
+	TIMESTAMP_DELTA = "delta"
+	// time since tailf was started
+	TIMESTAMP_ELAPSED = "elapsed"
+	// default layout
+	TIMESTAMP_DEFAULT = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// named Go time layouts
+var timestampLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"time":        "15:04:05.000",
+	"unix":        "unix",
+}
+
+// Timestamper prefixes lines with the time they were read, either as
+// an absolute time or relative to the previous line or to the start
+type Timestamper struct {
+	format string
+	start  time.Time
+	last   time.Time
+}
+
+func newTimestamper(format string, start time.Time) *Timestamper {
+	if format == "" {
+		format = TIMESTAMP_DEFAULT
+	}
+
+	if l, ok := timestampLayouts[strings.ToLower(format)]; ok {
+		format = l
+	}
+
+	return &Timestamper{
+		format: format,
+		start:  start,
+		last:   start,
+	}
+}
+
+// stamp formats the read time of a line
+func (ts *Timestamper) stamp(t time.Time) string {
+	var s string
+	switch ts.format {
+	case TIMESTAMP_DELTA:
+		s = formatDuration(t.Sub(ts.last))
+	case TIMESTAMP_ELAPSED:
+		s = formatDuration(t.Sub(ts.start))
+	case "unix":
+		s = fmt.Sprintf("%d.%03d", t.Unix(), t.Nanosecond()/int(time.Millisecond))
+	default:
+		s = t.Format(ts.format)
+	}
+
+	ts.last = t
+	return s
+}
+
+// formatDuration shows a duration in seconds, with millisecond
+// precision, in a fixed width
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	return fmt.Sprintf("+%10.3fs", d.Seconds())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+)
+
+// exit codes of tailf
+const (
+	// the --until pattern showed up, or tailing was interrupted when
+	// not waiting for it
+	EXIT_OK = 0
+	// invalid arguments, or the files couldn't be read
+	EXIT_ERROR = 1
+	// a --fail-on pattern showed up
+	EXIT_FAIL_ON = 2
+	// the --timeout passed before the --until pattern showed up
+	EXIT_TIMEOUT = 3
+	// tailing ended before the --until pattern showed up, ie: on a
+	// signal or with the files deleted
+	EXIT_UNMATCHED = 4
+)
+
+// ExitWatch ends tailing when a line matches one of its expressions,
+// with success for the until ones and failure for the fail on ones
+type ExitWatch struct {
+	until  []*regexp.Regexp
+	failOn []*regexp.Regexp
+}
+
+// newExitWatch compiles the given expressions into an ExitWatch.
+// Returns nil if there's nothing to watch for
+func newExitWatch(until, failOn []string) (*ExitWatch, error) {
+	if len(until)+len(failOn) == 0 {
+		return nil, nil
+	}
+
+	w := &ExitWatch{}
+
+	var err error
+	if w.until, err = compileAll(w.until, until, ""); err != nil {
+		return nil, err
+	}
+
+	if w.failOn, err = compileAll(w.failOn, failOn, ""); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// check returns the exit code the line ends tailing with, and whether
+// it does
+func (w *ExitWatch) check(l *Line) (int, bool) {
+	// failures take precedence, a line can't be a success and a failure
+	for _, re := range w.failOn {
+		if re.MatchString(l.text) {
+			return EXIT_FAIL_ON, true
+		}
+	}
+
+	for _, re := range w.until {
+		if re.MatchString(l.text) {
+			return EXIT_OK, true
+		}
+	}
+
+	return 0, false
+}
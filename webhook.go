@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaults of the webhook notifications
+const (
+	DEFAULT_WEBHOOK_BATCH   = 2 * time.Second
+	DEFAULT_WEBHOOK_RETRIES = 3
+	DEFAULT_ALERT_CONTEXT   = 3
+	// how long to wait for the alerts to be sent on shutdown
+	WEBHOOK_CLOSE_TIMEOUT = 5 * time.Second
+)
+
+// Alert is a line that matched an alert rule
+type Alert struct {
+	Rule   string `json:"rule"`
+	File   string `json:"file"`
+	Line   string `json:"line"`
+	LineNo int64  `json:"line_no,omitempty"`
+	Time   string `json:"time"`
+	Level  string `json:"level,omitempty"`
+	// the lines before the matching one
+	Context []string `json:"context,omitempty"`
+}
+
+// webhookPayload is what the body of a notification is made of, in json
+// or through the body template
+type webhookPayload struct {
+	Host   string   `json:"host"`
+	Count  int      `json:"count"`
+	Alerts []*Alert `json:"alerts"`
+}
+
+// Notifier posts the alerts to a webhook. Alerts coming in bursts are
+// sent together, and failed posts are retried with a backoff.
+type Notifier struct {
+	url     string
+	headers http.Header
+	// renders the body, nil to post the payload as json
+	body *template.Template
+	// how long alerts are collected for before they're sent
+	batch time.Duration
+	// how many times a failed post is retried, waiting twice as long
+	// each time, starting with backoff
+	retries int
+	backoff time.Duration
+	host    string
+	alerts  chan *Alert
+	client  *http.Client
+	// the posts being made, and closed once they're done on shutdown
+	sending  sync.WaitGroup
+	finished chan struct{}
+}
+
+// newNotifier creates a Notifier posting to the url. Headers are given
+// as "Name: value".
+func newNotifier(url string, headers []string, body string) (*Notifier, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("not an http url: %s", url)
+	}
+
+	n := &Notifier{
+		url:      url,
+		headers:  make(http.Header),
+		batch:    DEFAULT_WEBHOOK_BATCH,
+		retries:  DEFAULT_WEBHOOK_RETRIES,
+		backoff:  time.Second,
+		alerts:   make(chan *Alert, 256),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		finished: make(chan struct{}),
+	}
+
+	for _, h := range headers {
+		i := strings.Index(h, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %s, expected Name: value", h)
+		}
+
+		n.headers.Set(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+
+	if body != "" {
+		tmpl, err := template.New("webhook").
+			Funcs(templateFuncs).
+			Funcs(template.FuncMap{"json": toJSON}).
+			Option("missingkey=zero").
+			Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body template: %s", err)
+		}
+
+		n.body = tmpl
+	} else if n.headers.Get("Content-Type") == "" {
+		// the body a template renders can be anything
+		n.headers.Set("Content-Type", "application/json")
+	}
+
+	n.host, _ = os.Hostname()
+
+	return n, nil
+}
+
+// notify queues the alert to be sent. Alerts are dropped if too many are
+// waiting, rather than holding back the tailing.
+func (n *Notifier) notify(a *Alert) {
+	select {
+	case n.alerts <- a:
+	default:
+		debug(fmt.Sprintf("webhook: too many alerts waiting, dropped %s", a.Rule))
+	}
+}
+
+// start collects the alerts and sends them together, the batch interval
+// after the first one came in. On shutdown, the alerts waiting are sent
+// right away.
+func (n *Notifier) start(done <-chan bool) {
+	defer close(n.finished)
+
+	batch := make([]*Alert, 0)
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case a := <-n.alerts:
+			// the first alert of a burst starts the batch
+			if len(batch) == 0 {
+				flush = time.After(n.batch)
+			}
+			batch = append(batch, a)
+		case <-flush:
+			n.sendAsync(batch)
+			batch = make([]*Alert, 0)
+			flush = nil
+		case <-done:
+			// whatever came in last, ie: for the line ending tailing
+			for len(n.alerts) > 0 {
+				batch = append(batch, <-n.alerts)
+			}
+
+			if len(batch) > 0 {
+				n.sendAsync(batch)
+			}
+
+			n.sending.Wait()
+			return
+		}
+	}
+}
+
+// sendAsync posts the alerts without waiting for it
+func (n *Notifier) sendAsync(alerts []*Alert) {
+	n.sending.Add(1)
+	go func() {
+		defer n.sending.Done()
+		n.send(alerts)
+	}()
+}
+
+// close waits for the alerts to be sent after a shutdown, for a while
+func (n *Notifier) close() {
+	select {
+	case <-n.finished:
+	case <-time.After(WEBHOOK_CLOSE_TIMEOUT):
+		printErr("webhook: gave up on sending the last alerts")
+	}
+}
+
+// send posts the alerts, retrying on failures
+func (n *Notifier) send(alerts []*Alert) {
+	payload := &webhookPayload{Host: n.host, Count: len(alerts), Alerts: alerts}
+
+	var body bytes.Buffer
+	var err error
+	if n.body != nil {
+		err = n.body.Execute(&body, payload)
+	} else {
+		err = json.NewEncoder(&body).Encode(payload)
+	}
+
+	if err != nil {
+		printErr(fmt.Sprintf("webhook: couldn't render the notification: %s", err))
+		return
+	}
+
+	wait := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(body.Bytes())
+		if err == nil {
+			debug(fmt.Sprintf("webhook: sent %d alerts", len(alerts)))
+			return
+		}
+
+		if attempt >= n.retries {
+			break
+		}
+
+		debug(fmt.Sprintf("webhook: %s, retrying in %s", err, wait))
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	printErr(fmt.Sprintf("webhook: couldn't send %d alerts: %s", len(alerts), err))
+}
+
+// post makes a single post of the body
+func (n *Notifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = n.headers
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// toJSON marshals the value for the body template
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// AlertRule notifies when a line matches its expression
+type AlertRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// newAlertRule parses a <name>:<regex> rule, ie: oom:OutOfMemoryError
+func newAlertRule(spec string) (*AlertRule, error) {
+	i := strings.Index(spec, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("missing the name of the alert rule %s, expected name:regex", spec)
+	}
+
+	re, err := regexp.Compile(spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %s: %s", spec[i+1:], err)
+	}
+
+	return &AlertRule{name: spec[:i], re: re}, nil
+}
+
+// Alerts checks the lines of a file with the alert rules, keeping the
+// lines before as the context of the alerts
+type Alerts struct {
+	rules    []*AlertRule
+	notifier *Notifier
+	// the last lines of the file, up to the context size
+	recent  []string
+	context int
+}
+
+func newAlerts(rules []*AlertRule, notifier *Notifier, context int) *Alerts {
+	return &Alerts{
+		rules:    rules,
+		notifier: notifier,
+		recent:   make([]string, 0, context),
+		context:  context,
+	}
+}
+
+// check notifies of the line if it's shown and matches any of the rules,
+// once for each matching rule. The alerts have the time the line was read.
+func (a *Alerts) check(fname string, l *Line, shown bool, readAt time.Time) {
+	if shown {
+		for _, r := range a.rules {
+			if !r.re.MatchString(l.text) {
+				continue
+			}
+
+			a.notifier.notify(&Alert{
+				Rule:    r.name,
+				File:    fname,
+				Line:    l.text,
+				LineNo:  l.lineNo,
+				Time:    readAt.Format(time.RFC3339Nano),
+				Level:   levelLabel(l.level),
+				Context: append([]string{}, a.recent...),
+			})
+		}
+	}
+
+	if a.context == 0 {
+		return
+	}
+
+	if len(a.recent) == a.context {
+		a.recent = a.recent[1:]
+	}
+	a.recent = append(a.recent, l.text)
+}
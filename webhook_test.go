@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the posts made to it, failing the first ones
+type webhookServer struct {
+	sync.Mutex
+	*httptest.Server
+	fail  int
+	posts []webhookPost
+}
+
+type webhookPost struct {
+	at     time.Time
+	header http.Header
+	body   string
+}
+
+func newWebhookServer(fail int) *webhookServer {
+	s := &webhookServer{fail: fail}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.Lock()
+		defer s.Unlock()
+
+		s.posts = append(s.posts, webhookPost{at: time.Now(), header: r.Header, body: string(body)})
+		if len(s.posts) <= s.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	return s
+}
+
+func (s *webhookServer) received() []webhookPost {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]webhookPost{}, s.posts...)
+}
+
+func testNotifier(t *testing.T, url string, headers []string, body string) *Notifier {
+	n, err := newNotifier(url, headers, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = 20 * time.Millisecond
+
+	return n
+}
+
+func TestNotifierRetries(t *testing.T) {
+	s := newWebhookServer(2)
+	defer s.Close()
+
+	n := testNotifier(t, s.URL, nil, "")
+	n.send([]*Alert{{Rule: "oom", Line: "OutOfMemoryError"}})
+
+	posts := s.received()
+	if len(posts) != 3 {
+		t.Fatalf("expected 3 posts, got %d", len(posts))
+	}
+
+	// waiting twice as long before each retry
+	if d := posts[1].at.Sub(posts[0].at); d < 20*time.Millisecond {
+		t.Errorf("first retry after %s, expected 20ms at least", d)
+	}
+
+	if d := posts[2].at.Sub(posts[1].at); d < 40*time.Millisecond {
+		t.Errorf("second retry after %s, expected 40ms at least", d)
+	}
+}
+
+func TestNotifierGivesUp(t *testing.T) {
+	s := newWebhookServer(100)
+	defer s.Close()
+
+	n := testNotifier(t, s.URL, nil, "")
+	n.retries = 2
+	n.send([]*Alert{{Rule: "oom"}})
+
+	if posts := s.received(); len(posts) != 3 {
+		t.Fatalf("expected a post and 2 retries, got %d posts", len(posts))
+	}
+}
+
+func TestNotifierBatch(t *testing.T) {
+	s := newWebhookServer(0)
+	defer s.Close()
+
+	n := testNotifier(t, s.URL, nil, "")
+	n.batch = 100 * time.Millisecond
+
+	done := make(chan bool)
+	go n.start(done)
+
+	for _, rule := range []string{"a", "b", "c"} {
+		n.notify(&Alert{Rule: rule})
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	n.notify(&Alert{Rule: "d"})
+	time.Sleep(300 * time.Millisecond)
+
+	close(done)
+	n.close()
+
+	posts := s.received()
+	if len(posts) != 2 {
+		t.Fatalf("expected 2 posts, got %d", len(posts))
+	}
+
+	counts := make([]int, 0, len(posts))
+	for _, p := range posts {
+		var payload webhookPayload
+		if err := json.Unmarshal([]byte(p.body), &payload); err != nil {
+			t.Fatalf("invalid payload %s: %s", p.body, err)
+		}
+		counts = append(counts, payload.Count)
+	}
+
+	if counts[0] != 3 || counts[1] != 1 {
+		t.Errorf("expected batches of 3 and 1 alerts, got %v", counts)
+	}
+}
+
+func TestNotifierSendsOnShutdown(t *testing.T) {
+	s := newWebhookServer(0)
+	defer s.Close()
+
+	n := testNotifier(t, s.URL, nil, "")
+	n.batch = time.Hour
+
+	done := make(chan bool)
+	go n.start(done)
+
+	n.notify(&Alert{Rule: "fatal"})
+	close(done)
+	n.close()
+
+	if posts := s.received(); len(posts) != 1 {
+		t.Fatalf("expected the alert to be posted on shutdown, got %d posts", len(posts))
+	}
+}
+
+func TestNotifierHeaders(t *testing.T) {
+	s := newWebhookServer(0)
+	defer s.Close()
+
+	n := testNotifier(t, s.URL, []string{"Authorization: Bearer x", "X-Team:  ops "}, "")
+	n.send([]*Alert{{Rule: "oom"}})
+
+	posts := s.received()
+	if len(posts) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(posts))
+	}
+
+	h := posts[0].header
+	for name, expected := range map[string]string{
+		"Authorization": "Bearer x",
+		"X-Team":        "ops",
+		"Content-Type":  "application/json",
+	} {
+		if v := h.Get(name); v != expected {
+			t.Errorf("expected %s header %q, got %q", name, expected, v)
+		}
+	}
+}
+
+func TestNotifierTemplate(t *testing.T) {
+	s := newWebhookServer(0)
+	defer s.Close()
+
+	body := `{{.Count}} alerts:{{range .Alerts}} {{.Rule}}={{json .Line}}{{end}}`
+	n := testNotifier(t, s.URL, nil, body)
+	n.send([]*Alert{{Rule: "oom", Line: "heap"}, {Rule: "disk", Line: "full"}})
+
+	posts := s.received()
+	if len(posts) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(posts))
+	}
+
+	expected := `2 alerts: oom="heap" disk="full"`
+	if posts[0].body != expected {
+		t.Errorf("expected body %s, got %s", expected, posts[0].body)
+	}
+
+	// the rendered body isn't json
+	if v := posts[0].header.Get("Content-Type"); v != "" {
+		t.Errorf("expected no Content-Type header, got %q", v)
+	}
+}
+
+func TestNewNotifierInvalid(t *testing.T) {
+	for _, c := range []struct {
+		url     string
+		headers []string
+		body    string
+	}{
+		{url: "ftp://example.com"},
+		{url: "http://example.com", headers: []string{"no colon"}},
+		{url: "http://example.com", body: "{{.Count"},
+	} {
+		if _, err := newNotifier(c.url, c.headers, c.body); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}